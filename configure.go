@@ -0,0 +1,92 @@
+package hookworm
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	handlerPending    = "pending"
+	handlerConfigured = "configured"
+	handlerFailed     = "failed"
+)
+
+// HandlerStatus records how configuring a shell handler went, as logged
+// when the pipeline is built and exposed at /handlers.  The Duration is in
+// seconds.
+type HandlerStatus struct {
+	Handler      string     `json:"handler"`
+	State        string     `json:"state"`
+	Error        string     `json:"error,omitempty"`
+	ConfiguredAt *time.Time `json:"configured_at,omitempty"`
+	Duration     float64    `json:"duration"`
+
+	err error
+}
+
+func newHandlerStatus(handler string, start time.Time, err error) *HandlerStatus {
+	status := &HandlerStatus{
+		Handler:      handler,
+		State:        handlerConfigured,
+		ConfiguredAt: &start,
+		Duration:     time.Since(start).Seconds(),
+		err:          err,
+	}
+
+	if err != nil {
+		status.State = handlerFailed
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// configureTimeout is the timeout for each handler's configure phase, which
+// defaults to the handler timeout
+func (cfg *HandlerConfig) configureTimeout() int {
+	if cfg.ConfigureTimeout > 0 {
+		return cfg.ConfigureTimeout
+	}
+	return cfg.WormTimeout
+}
+
+// configureHandlers configures the handlers concurrently and returns how
+// each fared, in pipeline order
+func configureHandlers(handlers []*shellHandler) []*HandlerStatus {
+	var wg sync.WaitGroup
+	for _, sh := range handlers {
+		wg.Add(1)
+		go func(sh *shellHandler) {
+			defer wg.Done()
+			sh.configure()
+		}(sh)
+	}
+	wg.Wait()
+
+	return handlerStatuses(handlers)
+}
+
+func handlerStatuses(handlers []*shellHandler) []*HandlerStatus {
+	statuses := []*HandlerStatus{}
+	for _, sh := range handlers {
+		statuses = append(statuses, sh.configureStatus())
+	}
+	return statuses
+}
+
+// configureError returns an error naming the handlers that failed to
+// configure, if any
+func configureError(statuses []*HandlerStatus) error {
+	var failed []string
+	for _, status := range statuses {
+		if status.State == handlerFailed {
+			failed = append(failed, status.Error)
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d handler(s) failed to configure: %s", len(failed), strings.Join(failed, "; "))
+}
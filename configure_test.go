@@ -0,0 +1,170 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const configureHandlerBody = `#!/usr/bin/env python
+import os
+import sys
+import time
+
+name = os.path.basename(sys.argv[0])
+if sys.argv[1] == 'configure':
+    with open(os.path.join(os.path.dirname(sys.argv[0]), '.' + name + '.configured'), 'a') as f:
+        f.write('configured\n')
+    time.sleep(float(os.environ.get('CONFIGURE_SLEEP') or 0))
+    if name.startswith('10-'):
+        sys.stderr.write('missing credentials\n')
+        sys.exit(1)
+    if name.startswith('30-'):
+        print('{"events": ["never"]}')
+        sys.exit(78)
+    sys.exit(0)
+
+sys.stdout.write(sys.stdin.read())
+`
+
+func setupConfigureWormDir(t *testing.T) string {
+	dir := newJournalTestDir(t)
+	for _, name := range []string{"10-broken.py", "20-working.py"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(configureHandlerBody), 0755)
+	}
+	return dir
+}
+
+func configureCount(dir, name string) int {
+	content, _ := ioutil.ReadFile(filepath.Join(dir, "."+name+".configured"))
+	return strings.Count(string(content), "configured\n")
+}
+
+func TestConfigureFailureMarksAndSkipsHandler(t *testing.T) {
+	dir := setupConfigureWormDir(t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := handlerStatuses(shellHandlers(pipeline))
+	if len(statuses) != 2 || statuses[0].State != handlerFailed || statuses[1].State != handlerConfigured {
+		t.Fatalf("expected the broken handler to be marked as failed: %+v", statuses)
+	}
+
+	if !strings.Contains(statuses[0].Error, "10-broken.py") {
+		t.Errorf("expected the error to name the handler: %q", statuses[0].Error)
+	}
+
+	for i := 0; i < 2; i++ {
+		delivery := &Delivery{Source: "github"}
+		if _, err := pipeline.HandlePayload(delivery, `{}`); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(delivery.Results) != 2 || delivery.Results[0].Status != resultUnconfigured ||
+			delivery.Results[1].Status != resultUnchanged {
+			t.Errorf("expected the broken handler to be skipped: %+v", delivery.Results)
+		}
+	}
+
+	if configureCount(dir, "10-broken.py") != 1 || configureCount(dir, "20-working.py") != 1 {
+		t.Errorf("expected each handler to be configured once, got %d and %d",
+			configureCount(dir, "10-broken.py"), configureCount(dir, "20-working.py"))
+	}
+}
+
+func TestConfigureNoopIsConfigured(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "30-noop.py"), []byte(configureHandlerBody), 0755)
+
+	pipeline, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := handlerStatuses(shellHandlers(pipeline))
+	if len(statuses) != 1 || statuses[0].State != handlerConfigured {
+		t.Fatalf("expected a handler exiting 78 on configure to be configured: %+v", statuses)
+	}
+
+	delivery := &Delivery{Source: "github", Event: "push"}
+	if _, err := pipeline.HandlePayload(delivery, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(delivery.Results) != 1 || delivery.Results[0].Status != resultUnchanged {
+		t.Errorf("expected the handler to run without declaring anything: %+v", delivery.Results)
+	}
+}
+
+func TestConfigureRunsConcurrently(t *testing.T) {
+	dir := setupConfigureWormDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CONFIGURE_SLEEP", "1")
+	defer os.Setenv("CONFIGURE_SLEEP", "")
+
+	start := time.Now()
+	if _, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 1800*time.Millisecond {
+		t.Errorf("expected handlers to be configured concurrently, took %v", elapsed)
+	}
+}
+
+func TestConfigureTimeout(t *testing.T) {
+	dir := setupConfigureWormDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("CONFIGURE_SLEEP", "5")
+	defer os.Setenv("CONFIGURE_SLEEP", "")
+
+	pipeline, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 10, ConfigureTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := handlerStatuses(shellHandlers(pipeline))
+	if statuses[1].State != handlerFailed || !strings.Contains(statuses[1].Error, "timed out after 1s") {
+		t.Errorf("expected configure to time out: %+v", statuses[1])
+	}
+}
+
+func TestStrictConfigureFailsStartup(t *testing.T) {
+	dir := setupConfigureWormDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5, Strict: true})
+	if err == nil || !strings.HasPrefix(err.Error(), "1 handler(s) failed to configure: 10-broken.py") {
+		t.Errorf("expected strict startup to fail naming the handler, got %v", err)
+	}
+}
+
+func TestReloadRetriesFailedConfigure(t *testing.T) {
+	dir := setupConfigureWormDir(t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pipeline.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if configureCount(dir, "10-broken.py") != 2 || configureCount(dir, "20-working.py") != 1 {
+		t.Errorf("expected only the failed handler to be configured again, got %d and %d",
+			configureCount(dir, "10-broken.py"), configureCount(dir, "20-working.py"))
+	}
+}
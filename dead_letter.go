@@ -0,0 +1,193 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	deadLetterDirName = "dead-letters"
+)
+
+var (
+	deadLetterIDRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// deadLetter is a delivery that failed in the pipeline, kept along with
+// everything needed to inspect the failure and requeue the payload
+type deadLetter struct {
+	ID         string      `json:"id"`
+	DeliveryID string      `json:"delivery_id"`
+	SourceID   string      `json:"source_id,omitempty"`
+	Source     string      `json:"source"`
+	Event      string      `json:"event"`
+	Headers    http.Header `json:"headers,omitempty"`
+	Payload    string      `json:"payload,omitempty"`
+	Handler    string      `json:"handler"`
+	ExitStatus int         `json:"exit_status"`
+	TimedOut   bool        `json:"timed_out,omitempty"`
+	Limit      string      `json:"limit,omitempty"`
+	Stderr     string      `json:"stderr,omitempty"`
+	Error      string      `json:"error"`
+	Time       time.Time   `json:"time"`
+}
+
+// summary returns a copy of the dead letter without the bulky bits, for
+// listings
+func (dl *deadLetter) summary() *deadLetter {
+	ret := *dl
+	ret.Headers = nil
+	ret.Payload = ""
+	ret.Stderr = ""
+	return &ret
+}
+
+// deadLetterStore keeps one JSON file per dead letter in the data dir
+type deadLetterStore struct {
+	sync.Mutex
+	dir string
+}
+
+func openDeadLetterStore(dataDir string) (*deadLetterStore, error) {
+	dir := filepath.Join(dataDir, deadLetterDirName)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &deadLetterStore{dir: dir}, nil
+}
+
+func (dls *deadLetterStore) path(id string) string {
+	return filepath.Join(dls.dir, id+".json")
+}
+
+// add records a failed delivery.  Failures from shell handlers carry the
+// handler path, exit status and stderr tail.
+func (dls *deadLetterStore) add(d *Delivery, payload string, err error) (*deadLetter, error) {
+	dl := &deadLetter{
+		ID:         newDeliveryID(),
+		DeliveryID: d.ID,
+		SourceID:   d.SourceID,
+		Source:     d.Source,
+		Event:      d.Event,
+		Headers:    d.Headers,
+		Payload:    payload,
+		ExitStatus: -1,
+		Error:      err.Error(),
+		Time:       time.Now().UTC(),
+	}
+
+	if he, ok := err.(*handlerError); ok {
+		dl.Handler = he.Handler
+		dl.ExitStatus = he.ExitStatus
+		dl.TimedOut = he.TimedOut
+		dl.Limit = he.Limit
+		dl.Stderr = he.Stderr
+	}
+
+	content, err := json.MarshalIndent(dl, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	dls.Lock()
+	defer dls.Unlock()
+
+	tmpPath := dls.path(dl.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0640); err != nil {
+		return nil, err
+	}
+
+	return dl, os.Rename(tmpPath, dls.path(dl.ID))
+}
+
+// get returns the dead letter with the given ID, or nil if there is none
+func (dls *deadLetterStore) get(id string) (*deadLetter, error) {
+	if !deadLetterIDRegexp.MatchString(id) {
+		return nil, nil
+	}
+
+	dls.Lock()
+	defer dls.Unlock()
+
+	content, err := ioutil.ReadFile(dls.path(id))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dl := &deadLetter{}
+	if err := json.Unmarshal(content, dl); err != nil {
+		return nil, err
+	}
+
+	return dl, nil
+}
+
+// list returns summaries of all dead letters, most recent first
+func (dls *deadLetterStore) list() ([]*deadLetter, error) {
+	dls.Lock()
+	names, err := filepath.Glob(filepath.Join(dls.dir, "*.json"))
+	dls.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*deadLetter{}
+	for _, name := range names {
+		dl, err := dls.get(strings.TrimSuffix(filepath.Base(name), ".json"))
+		if err != nil {
+			logger.Printf("Skipping unreadable dead letter %v: %v\n", name, err)
+			continue
+		}
+		if dl != nil {
+			ret = append(ret, dl.summary())
+		}
+	}
+
+	sort.Sort(deadLettersByTime(ret))
+	return ret, nil
+}
+
+// remove deletes the dead letter with the given ID, returning false if
+// there was none
+func (dls *deadLetterStore) remove(id string) (bool, error) {
+	if !deadLetterIDRegexp.MatchString(id) {
+		return false, nil
+	}
+
+	dls.Lock()
+	defer dls.Unlock()
+
+	err := os.Remove(dls.path(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+type deadLettersByTime []*deadLetter
+
+func (dlt deadLettersByTime) Len() int {
+	return len(dlt)
+}
+
+func (dlt deadLettersByTime) Less(i, j int) bool {
+	return dlt[i].Time.After(dlt[j].Time)
+}
+
+func (dlt deadLettersByTime) Swap(i, j int) {
+	dlt[i], dlt[j] = dlt[j], dlt[i]
+}
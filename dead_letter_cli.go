@@ -0,0 +1,188 @@
+package hookworm
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// DeadLettersMain is the entry point for the `dead-letters` subcommand of
+// the `hookworm-server` executable, which manages the dead letters of a
+// running server via its HTTP API
+func DeadLettersMain(args []string) int {
+	return deadLettersMain(args, os.Stdout, os.Stderr)
+}
+
+func deadLettersMain(args []string, stdout, stderr io.Writer) int {
+	var (
+		addr      = os.Getenv("HOOKWORM_ADDR")
+		basicAuth = os.Getenv("HOOKWORM_BASIC_AUTH")
+		fl        = flag.NewFlagSet("dead-letters", flag.ContinueOnError)
+	)
+
+	if addr == "" {
+		addr = ":9988"
+	}
+
+	fl.SetOutput(stderr)
+	fl.StringVar(&addr, "a", addr, "Server address [HOOKWORM_ADDR]")
+	fl.StringVar(&basicAuth, "b", basicAuth, "Basic auth username:password [HOOKWORM_BASIC_AUTH]")
+	fl.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %v dead-letters [options] list|show <id>|requeue <id>|discard <id>\n", progName)
+		fl.PrintDefaults()
+	}
+
+	if err := fl.Parse(args); err != nil {
+		return 2
+	}
+
+	command, id := fl.Arg(0), fl.Arg(1)
+	if command == "" || (command != "list" && id == "") {
+		fl.Usage()
+		return 2
+	}
+
+	client := &deadLetterClient{baseURL: serverURL(addr), basicAuth: basicAuth}
+
+	var err error
+	switch command {
+	case "list":
+		err = client.list(stdout)
+	case "show":
+		err = client.show(id, stdout)
+	case "requeue":
+		err = client.requeue(id, stdout)
+	case "discard":
+		err = client.discard(id, stdout)
+	default:
+		fl.Usage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(stderr, "ERROR: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// serverURL turns a server listen address such as ":9988" into a URL that
+// may be used to reach it
+func serverURL(addr string) string {
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		return strings.TrimRight(addr, "/")
+	}
+
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+
+	return "http://" + addr
+}
+
+type deadLetterClient struct {
+	baseURL   string
+	basicAuth string
+}
+
+func (dlc *deadLetterClient) do(method, path string) (int, []byte, error) {
+	req, err := http.NewRequest(method, dlc.baseURL+path, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if authParts := strings.SplitN(dlc.basicAuth, ":", 2); len(authParts) == 2 {
+		req.SetBasicAuth(authParts[0], authParts[1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, body, fmt.Errorf("%s %s: %s %s",
+			method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return resp.StatusCode, body, nil
+}
+
+func (dlc *deadLetterClient) list(out io.Writer) error {
+	_, body, err := dlc.do("GET", "/dead-letters")
+	if err != nil {
+		return err
+	}
+
+	deadLetters := []*deadLetter{}
+	if err := json.Unmarshal(body, &deadLetters); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tSOURCE\tEVENT\tHANDLER\tSTATUS\tDELIVERY")
+	for _, dl := range deadLetters {
+		status := strconv.Itoa(dl.ExitStatus)
+		if dl.TimedOut {
+			status = "timeout"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", dl.ID, dl.Time.Format(rfc2822DateFmt),
+			dl.Source, dl.Event, dl.Handler, status, dl.DeliveryID)
+	}
+
+	return tw.Flush()
+}
+
+func (dlc *deadLetterClient) show(id string, out io.Writer) error {
+	_, body, err := dlc.do("GET", "/dead-letters/"+id)
+	if err != nil {
+		return err
+	}
+
+	indented := &bytes.Buffer{}
+	if err := json.Indent(indented, body, "", "  "); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, indented.String())
+	return nil
+}
+
+func (dlc *deadLetterClient) requeue(id string, out io.Writer) error {
+	status, body, err := dlc.do("POST", "/dead-letters/"+id+"/requeue")
+	if err != nil {
+		return err
+	}
+
+	if status == http.StatusAccepted {
+		fmt.Fprintf(out, "Requeued dead letter %s: %s\n", id, strings.TrimSpace(string(body)))
+	} else {
+		fmt.Fprintf(out, "Requeued dead letter %s and handled it successfully\n", id)
+	}
+	return nil
+}
+
+func (dlc *deadLetterClient) discard(id string, out io.Writer) error {
+	if _, _, err := dlc.do("DELETE", "/dead-letters/"+id); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Discarded dead letter %s\n", id)
+	return nil
+}
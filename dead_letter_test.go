@@ -0,0 +1,273 @@
+package hookworm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/martini"
+)
+
+const failingHandlerBody = `#!/usr/bin/env python
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+
+if not os.path.exists(os.path.join(os.path.dirname(__file__), 'fixed')):
+    sys.stderr.write('something broke\n')
+    sys.exit(2)
+
+sys.stdout.write(sys.stdin.read())
+sys.exit(0)
+`
+
+func setupDeadLetterServer(t *testing.T) (string, *martini.ClassicMartini) {
+	dir := newJournalTestDir(t)
+
+	wormDir := filepath.Join(dir, "worm.d")
+	os.MkdirAll(wormDir, 0750)
+	ioutil.WriteFile(filepath.Join(wormDir, "00-fails.py"), []byte(failingHandlerBody), 0755)
+
+	cfg := *serverTestConfig
+	cfg.DataDir = filepath.Join(dir, "data")
+	cfg.WormDir = wormDir
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, m
+}
+
+func serveDeadLetterRequest(m *martini.ClassicMartini, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+	return hr
+}
+
+func failGithubDelivery(m *martini.ClassicMartini, t *testing.T) *deadLetter {
+	req, _ := http.NewRequest("POST", "/github-test", getPayloadJSONReader("github", "valid"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+
+	if hr.Code != 500 {
+		t.Fatalf("unexpected status %v: %s", hr.Code, hr.Body.String())
+	}
+
+	hr = serveDeadLetterRequest(m, "GET", "/dead-letters")
+	deadLetters := []*deadLetter{}
+	if err := json.Unmarshal(hr.Body.Bytes(), &deadLetters); err != nil {
+		t.Fatal(err)
+	}
+	if len(deadLetters) != 1 {
+		t.Fatalf("expected one dead letter, got %s", hr.Body.String())
+	}
+
+	return deadLetters[0]
+}
+
+func TestDeadLetterStoreRoundTrip(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	dls, err := openDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Delivery{ID: "abc", Source: "github", Event: "push"}
+	failure := newHandlerError("/worm.d/00-nope.py", []byte("oh no\n"), fmt.Errorf("exit status 3"))
+	failure.ExitStatus = 3
+
+	added, err := dls.add(d, `{"ok":false}`, failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err := dls.get(added.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.DeliveryID != "abc" || dl.Payload != `{"ok":false}` || dl.Handler != "/worm.d/00-nope.py" ||
+		dl.ExitStatus != 3 || dl.Stderr != "oh no\n" || dl.Time.IsZero() {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+
+	list, err := dls.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != added.ID || list[0].Payload != "" {
+		t.Errorf("unexpected dead letter listing %+v", list)
+	}
+
+	if removed, err := dls.remove(added.ID); !removed || err != nil {
+		t.Errorf("failed to remove dead letter: %v", err)
+	}
+	if dl, _ := dls.get(added.ID); dl != nil {
+		t.Errorf("dead letter still present after removal")
+	}
+}
+
+func TestDeadLetterStoreRejectsBogusIDs(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	dls, _ := openDeadLetterStore(dir)
+	ioutil.WriteFile(filepath.Join(dir, "secret.json"), []byte(`{}`), 0640)
+
+	for _, id := range []string{"../secret", "secret", ""} {
+		if dl, err := dls.get(id); dl != nil || err != nil {
+			t.Errorf("%q: unexpected dead letter %+v %v", id, dl, err)
+		}
+		if removed, _ := dls.remove(id); removed {
+			t.Errorf("%q: unexpectedly removed", id)
+		}
+	}
+}
+
+func TestServerKeepsAndRequeuesDeadLetters(t *testing.T) {
+	dir, m := setupDeadLetterServer(t)
+	defer os.RemoveAll(dir)
+
+	summary := failGithubDelivery(m, t)
+	if summary.Source != "github" || summary.Event != "push" || summary.ExitStatus != 2 ||
+		!strings.HasSuffix(summary.Handler, "00-fails.py") {
+		t.Errorf("unexpected dead letter summary %+v", summary)
+	}
+
+	hr := serveDeadLetterRequest(m, "GET", "/dead-letters/"+summary.ID)
+	dl := &deadLetter{}
+	if err := json.Unmarshal(hr.Body.Bytes(), dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Payload != getPayload("github", "valid") || dl.Stderr != "something broke\n" {
+		t.Errorf("unexpected dead letter %+v", dl)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "worm.d", "fixed"), []byte{}, 0640)
+
+	hr = serveDeadLetterRequest(m, "POST", "/dead-letters/"+summary.ID+"/requeue")
+	if hr.Code != 204 {
+		t.Fatalf("unexpected requeue status %v: %s", hr.Code, hr.Body.String())
+	}
+
+	if hr = serveDeadLetterRequest(m, "GET", "/dead-letters/"+summary.ID); hr.Code != 404 {
+		t.Errorf("requeued dead letter still present: %v", hr.Code)
+	}
+}
+
+func TestRequeueKeepsDeadLetterWhenQueueFull(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	deadLetters, err := openDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dl, err := deadLetters.add(&Delivery{ID: "failed", Source: "github", Event: "push"}, `{}`, fmt.Errorf("nope"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dd := newDeliveryDispatcher(&testDeliveryHandler{}, nil, deadLetters, &HandlerConfig{})
+	dd.jobs = make(chan *deliveryJob)
+
+	status, _ := handleRequeueDeadLetter(dd, logger, martini.Params{"id": dl.ID}, httptest.NewRecorder())
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("expected requeue into a full queue to fail, got %v", status)
+	}
+
+	kept, err := deadLetters.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || kept[0].ID != dl.ID {
+		t.Errorf("expected only the original dead letter to be kept, got %+v", kept)
+	}
+}
+
+func TestServerDiscardsDeadLetters(t *testing.T) {
+	dir, m := setupDeadLetterServer(t)
+	defer os.RemoveAll(dir)
+
+	summary := failGithubDelivery(m, t)
+
+	if hr := serveDeadLetterRequest(m, "DELETE", "/dead-letters/"+summary.ID); hr.Code != 204 {
+		t.Fatalf("unexpected discard status %v: %s", hr.Code, hr.Body.String())
+	}
+	if hr := serveDeadLetterRequest(m, "DELETE", "/dead-letters/"+summary.ID); hr.Code != 404 {
+		t.Errorf("unexpected second discard status %v", hr.Code)
+	}
+}
+
+func TestServerDeadLettersWithoutDataDir(t *testing.T) {
+	resp := getResponse("GET", "/dead-letters", "", nil)
+	if resp.Code != 404 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestDeadLettersMain(t *testing.T) {
+	dir, m := setupDeadLetterServer(t)
+	defer os.RemoveAll(dir)
+
+	summary := failGithubDelivery(m, t)
+
+	server := httptest.NewServer(m)
+	defer server.Close()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if deadLettersMain([]string{"-a", server.URL, "list"}, stdout, stderr) != 0 {
+		t.Fatalf("list failed: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), summary.ID) {
+		t.Errorf("dead letter missing from listing %q", stdout.String())
+	}
+
+	stdout.Reset()
+	if deadLettersMain([]string{"-a", server.URL, "show", summary.ID}, stdout, stderr) != 0 {
+		t.Fatalf("show failed: %s", stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "something broke") {
+		t.Errorf("unexpected dead letter %q", stdout.String())
+	}
+
+	if deadLettersMain([]string{"-a", server.URL, "discard", summary.ID}, stdout, stderr) != 0 {
+		t.Fatalf("discard failed: %s", stderr.String())
+	}
+	if deadLettersMain([]string{"-a", server.URL, "requeue", summary.ID}, stdout, stderr) != 1 {
+		t.Errorf("expected requeue of discarded dead letter to fail")
+	}
+	if deadLettersMain([]string{"-a", server.URL, "show"}, stdout, stderr) != 2 {
+		t.Errorf("expected usage error without id")
+	}
+}
+
+func TestServerURL(t *testing.T) {
+	for addr, expected := range map[string]string{
+		":9988":                  "http://localhost:9988",
+		"example.org:80":         "http://example.org:80",
+		"https://example.org/":   "https://example.org",
+		"http://127.0.0.1:9988/": "http://127.0.0.1:9988",
+	} {
+		if actual := serverURL(addr); actual != expected {
+			t.Errorf("%q: expected %q, got %q", addr, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package hookworm
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	deliveryQueued    = "queued"
+	deliveryRunning   = "running"
+	deliveryCompleted = "completed"
+	deliveryFailed    = "failed"
+
+	defaultDeliveryStoreSize = 1000
+)
+
+var (
+	errQueueFull = errors.New("delivery queue is full")
+)
+
+// Delivery contains the request metadata that accompanies a payload as it
+// travels down the pipeline, along with the state of its processing.  The
+// ID is generated for every delivery accepted, while the SourceID is the
+// one given by the sender (e.g. X-GitHub-Delivery), if any, which is reused
+// when the sender redelivers the payload.
+type Delivery struct {
+	ID         string      `json:"id"`
+	SourceID   string      `json:"source_id,omitempty"`
+	Source     string      `json:"source"`
+	Event      string      `json:"event"`
+	Headers    http.Header `json:"headers,omitempty"`
+	State      string      `json:"state"`
+	Error      string      `json:"error,omitempty"`
+	AcceptedAt time.Time   `json:"accepted_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+
+	Results   []*HandlerResult `json:"results,omitempty"`
+	StderrLog string           `json:"stderr_log,omitempty"`
+
+	stderrLog *deliveryLog
+	tempDirs  []string
+	mu        sync.Mutex
+}
+
+// AddResult records the result of a handler in the delivery.  It is safe
+// to call from handlers running concurrently.
+func (d *Delivery) AddResult(result *HandlerResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.Results = append(d.Results, result)
+}
+
+// addTempDir records a directory to be removed once the delivery has been
+// handled
+func (d *Delivery) addTempDir(dir string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, existing := range d.tempDirs {
+		if existing == dir {
+			return
+		}
+	}
+	d.tempDirs = append(d.tempDirs, dir)
+}
+
+// removeTempDirs removes the directories created for the delivery
+func (d *Delivery) removeTempDirs() {
+	d.mu.Lock()
+	dirs := d.tempDirs
+	d.tempDirs = nil
+	d.mu.Unlock()
+
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Printf("ERROR: failed to remove %v for delivery %s: %v\n", dir, d.ID, err)
+		}
+	}
+}
+
+func (d *Delivery) setState(state string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.State = state
+	if err != nil {
+		d.Error = err.Error()
+	}
+
+	if state == deliveryCompleted || state == deliveryFailed {
+		now := time.Now().UTC()
+		d.FinishedAt = &now
+	}
+}
+
+// snapshot returns a copy of the delivery that is safe to hand to another
+// goroutine, e.g. for JSON rendering
+func (d *Delivery) snapshot() *Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return &Delivery{
+		ID:         d.ID,
+		SourceID:   d.SourceID,
+		Source:     d.Source,
+		Event:      d.Event,
+		Headers:    d.Headers,
+		State:      d.State,
+		Error:      d.Error,
+		AcceptedAt: d.AcceptedAt,
+		FinishedAt: d.FinishedAt,
+		Results:    append([]*HandlerResult(nil), d.Results...),
+		StderrLog:  d.StderrLog,
+	}
+}
+
+// newDeliveryID generates a random v4 UUID
+func newDeliveryID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// deliveryStore keeps the most recent deliveries in memory so that their
+// results may be inspected via the API
+type deliveryStore struct {
+	sync.Mutex
+	size       int
+	order      []string
+	deliveries map[string]*Delivery
+}
+
+func newDeliveryStore(size int) *deliveryStore {
+	if size < 1 {
+		size = defaultDeliveryStoreSize
+	}
+
+	return &deliveryStore{
+		size:       size,
+		deliveries: make(map[string]*Delivery),
+	}
+}
+
+func (ds *deliveryStore) add(d *Delivery) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	if _, ok := ds.deliveries[d.ID]; !ok {
+		ds.order = append(ds.order, d.ID)
+	}
+	ds.deliveries[d.ID] = d
+
+	for len(ds.order) > ds.size {
+		delete(ds.deliveries, ds.order[0])
+		ds.order = ds.order[1:]
+	}
+}
+
+func (ds *deliveryStore) get(id string) *Delivery {
+	ds.Lock()
+	defer ds.Unlock()
+
+	if d, ok := ds.deliveries[id]; ok {
+		return d.snapshot()
+	}
+
+	return nil
+}
+
+// list returns snapshots of the stored deliveries, most recent first
+func (ds *deliveryStore) list() []*Delivery {
+	ds.Lock()
+	defer ds.Unlock()
+
+	ret := []*Delivery{}
+	for i := len(ds.order) - 1; i >= 0; i-- {
+		ret = append(ret, ds.deliveries[ds.order[i]].snapshot())
+	}
+
+	return ret
+}
+
+type deliveryJob struct {
+	delivery *Delivery
+	payload  string
+}
+
+// deliveryDispatcher sends deliveries down the pipeline, either directly
+// within the calling goroutine or via a pool of background workers when
+// running in async mode.  When a journal is present, every delivery is
+// recorded there before it is processed, when a dead letter store is
+// present, every failed delivery is kept there, and when a stderr log store
+// is present, the standard error of the handlers run for each delivery is
+// written there.
+type deliveryDispatcher struct {
+	pipeline    Handler
+	store       *deliveryStore
+	journal     *deliveryJournal
+	deadLetters *deadLetterStore
+	stderrLogs  *stderrLogStore
+	jobs        chan *deliveryJob
+}
+
+func newDeliveryDispatcher(pipeline Handler, journal *deliveryJournal, deadLetters *deadLetterStore, cfg *HandlerConfig) *deliveryDispatcher {
+	dd := &deliveryDispatcher{
+		pipeline:    pipeline,
+		store:       newDeliveryStore(defaultDeliveryStoreSize),
+		journal:     journal,
+		deadLetters: deadLetters,
+	}
+
+	if cfg.Async {
+		workers := cfg.AsyncWorkers
+		if workers < 1 {
+			workers = 1
+		}
+
+		dd.jobs = make(chan *deliveryJob, cfg.AsyncQueueSize)
+		for i := 0; i < workers; i++ {
+			go dd.work()
+		}
+	}
+
+	return dd
+}
+
+func (dd *deliveryDispatcher) async() bool {
+	return dd.jobs != nil
+}
+
+// accept assigns an ID to the delivery if it lacks one, records it in the
+// store, and writes it to the journal
+func (dd *deliveryDispatcher) accept(d *Delivery, payload string) error {
+	d.ID = newDeliveryID()
+	d.AcceptedAt = time.Now().UTC()
+	d.State = deliveryQueued
+	dd.store.add(d)
+
+	if dd.journal == nil {
+		return nil
+	}
+
+	if err := dd.journal.accepted(d, payload); err != nil {
+		logger.Printf("ERROR: failed to journal delivery %s: %v\n", d.ID, err)
+		d.setState(deliveryFailed, err)
+		return err
+	}
+
+	return nil
+}
+
+// enqueue hands the delivery off to the worker pool without waiting for it
+// to be processed.  A delivery that finds the queue full has already been
+// accepted, so it fails and is kept as a dead letter like any other.
+func (dd *deliveryDispatcher) enqueue(d *Delivery, payload string) error {
+	if err := dd.offer(d, payload); err != nil {
+		logger.Printf("Delivery %s (%s %s) failed: %v\n", d.ID, d.Source, d.Event, err)
+		dd.deadLetter(d, payload, err)
+		return err
+	}
+	return nil
+}
+
+// offer hands the delivery off to the worker pool if there is room in the
+// queue, and fails it otherwise
+func (dd *deliveryDispatcher) offer(d *Delivery, payload string) error {
+	select {
+	case dd.jobs <- &deliveryJob{delivery: d, payload: payload}:
+		return nil
+	default:
+		dd.finish(d, errQueueFull)
+		return errQueueFull
+	}
+}
+
+// resume re-dispatches deliveries that were accepted by a previous process
+// but never finished
+func (dd *deliveryDispatcher) resume(pending []*journalEntry) {
+	if len(pending) > 0 {
+		logger.Printf("Resuming %d unfinished deliveries\n", len(pending))
+	}
+
+	for _, entry := range pending {
+		d := &Delivery{
+			ID:         entry.ID,
+			SourceID:   entry.SourceID,
+			Source:     entry.Source,
+			Event:      entry.Event,
+			Headers:    entry.Headers,
+			State:      deliveryQueued,
+			AcceptedAt: entry.Time,
+		}
+		dd.store.add(d)
+
+		if dd.async() {
+			dd.jobs <- &deliveryJob{delivery: d, payload: entry.Payload}
+		} else {
+			dd.process(d, entry.Payload)
+		}
+	}
+}
+
+func (dd *deliveryDispatcher) work() {
+	for job := range dd.jobs {
+		dd.process(job.delivery, job.payload)
+	}
+}
+
+// process sends the delivery down the pipeline and records the outcome
+func (dd *deliveryDispatcher) process(d *Delivery, payload string) error {
+	d.setState(deliveryRunning, nil)
+	start := time.Now()
+
+	if dd.stderrLogs != nil {
+		if err := dd.stderrLogs.open(d); err != nil {
+			logger.Printf("ERROR: failed to open stderr log of delivery %s: %v\n", d.ID, err)
+		}
+	}
+
+	_, err := dd.pipeline.HandlePayload(d, payload)
+
+	if dd.stderrLogs != nil {
+		dd.stderrLogs.close(d)
+	}
+	d.removeTempDirs()
+	dd.finish(d, err)
+
+	if err != nil {
+		logger.Printf("Delivery %s (%s %s) failed after %v: %v\n",
+			d.ID, d.Source, d.Event, time.Since(start), err)
+		dd.deadLetter(d, payload, err)
+		return err
+	}
+
+	logger.Printf("Delivery %s (%s %s) completed in %v\n",
+		d.ID, d.Source, d.Event, time.Since(start))
+	return nil
+}
+
+// finish records the outcome of the delivery in the store and journal
+func (dd *deliveryDispatcher) finish(d *Delivery, err error) {
+	if err != nil {
+		d.setState(deliveryFailed, err)
+	} else {
+		d.setState(deliveryCompleted, nil)
+	}
+
+	if dd.journal == nil {
+		return
+	}
+
+	if jErr := dd.journal.finished(d, err); jErr != nil {
+		logger.Printf("ERROR: failed to journal outcome of delivery %s: %v\n", d.ID, jErr)
+	}
+}
+
+// deadLetter keeps the failed delivery in the dead letter store, if any
+func (dd *deliveryDispatcher) deadLetter(d *Delivery, payload string, err error) {
+	if dd.deadLetters == nil {
+		return
+	}
+
+	dl, dlErr := dd.deadLetters.add(d, payload, err)
+	if dlErr != nil {
+		logger.Printf("ERROR: failed to store dead letter for delivery %s: %v\n", d.ID, dlErr)
+		return
+	}
+
+	logger.Printf("Stored delivery %s as dead letter %s\n", d.ID, dl.ID)
+}
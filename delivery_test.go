@@ -0,0 +1,229 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+var (
+	uuidRegexp = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+)
+
+type testDeliveryHandler struct {
+	next    Handler
+	err     error
+	release chan bool
+}
+
+func (tdh *testDeliveryHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	if tdh.release != nil {
+		<-tdh.release
+	}
+	return payload, tdh.err
+}
+
+func (tdh *testDeliveryHandler) SetNextHandler(n Handler) {
+	tdh.next = n
+}
+
+func (tdh *testDeliveryHandler) NextHandler() Handler {
+	return tdh.next
+}
+
+func waitForDeliveryState(dd *deliveryDispatcher, id, state string, t *testing.T) *Delivery {
+	for i := 0; i < 100; i++ {
+		d := dd.store.get(id)
+		if d != nil && d.State == state {
+			return d
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("delivery %s never reached state %q", id, state)
+	return nil
+}
+
+func TestNewDeliveryID(t *testing.T) {
+	id := newDeliveryID()
+	if !uuidRegexp.MatchString(id) {
+		t.Errorf("unexpected delivery id %q", id)
+	}
+	if id == newDeliveryID() {
+		t.Fail()
+	}
+}
+
+func TestDeliveryStoreEvictsOldest(t *testing.T) {
+	ds := newDeliveryStore(2)
+	for _, id := range []string{"a", "b", "c"} {
+		ds.add(&Delivery{ID: id})
+	}
+
+	if ds.get("a") != nil {
+		t.Errorf("expected oldest delivery to be evicted")
+	}
+
+	list := ds.list()
+	if len(list) != 2 || list[0].ID != "c" || list[1].ID != "b" {
+		t.Errorf("unexpected deliveries %+v", list)
+	}
+}
+
+func TestDeliveryDispatcherAcceptAssignsID(t *testing.T) {
+	dd := newDeliveryDispatcher(&testDeliveryHandler{}, nil, nil, &HandlerConfig{})
+	d := &Delivery{Source: "github"}
+	dd.accept(d, `{}`)
+
+	if !uuidRegexp.MatchString(d.ID) || d.State != deliveryQueued {
+		t.Errorf("unexpected accepted delivery %+v", d)
+	}
+
+	first := &Delivery{SourceID: "from-upstream", Source: "github"}
+	dd.accept(first, `{}`)
+	redelivered := &Delivery{SourceID: "from-upstream", Source: "github"}
+	dd.accept(redelivered, `{}`)
+
+	if first.ID == redelivered.ID || redelivered.SourceID != "from-upstream" || len(dd.store.list()) != 3 {
+		t.Errorf("expected a redelivery to be recorded separately, keeping the sender's ID: %+v %+v", first, redelivered)
+	}
+}
+
+func TestDeliveryDispatcherProcessRecordsFailure(t *testing.T) {
+	dd := newDeliveryDispatcher(&testDeliveryHandler{err: fmt.Errorf("nope")}, nil, nil, &HandlerConfig{})
+	d := &Delivery{Source: "github"}
+	dd.accept(d, `{}`)
+
+	if dd.process(d, `{}`) == nil {
+		t.Fail()
+	}
+
+	stored := dd.store.get(d.ID)
+	if stored.State != deliveryFailed || stored.Error != "nope" || stored.FinishedAt == nil {
+		t.Errorf("unexpected stored delivery %+v", stored)
+	}
+}
+
+func TestDeliveryDispatcherAsync(t *testing.T) {
+	handler := &testDeliveryHandler{release: make(chan bool)}
+	dd := newDeliveryDispatcher(handler, nil, nil, &HandlerConfig{Async: true, AsyncWorkers: 1, AsyncQueueSize: 1})
+
+	first := &Delivery{Source: "github"}
+	dd.accept(first, `{}`)
+	if err := dd.enqueue(first, `{}`); err != nil {
+		t.Fatal(err)
+	}
+	waitForDeliveryState(dd, first.ID, deliveryRunning, t)
+
+	second := &Delivery{Source: "github"}
+	dd.accept(second, `{}`)
+	if err := dd.enqueue(second, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	third := &Delivery{Source: "github"}
+	dd.accept(third, `{}`)
+	if err := dd.enqueue(third, `{}`); err != errQueueFull {
+		t.Errorf("expected full queue, got %v", err)
+	}
+
+	handler.release <- true
+	handler.release <- true
+
+	waitForDeliveryState(dd, first.ID, deliveryCompleted, t)
+	waitForDeliveryState(dd, second.ID, deliveryCompleted, t)
+}
+
+func TestDeliveryDispatcherDeadLettersQueueFull(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	deadLetters, err := openDeadLetterStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dd := newDeliveryDispatcher(&testDeliveryHandler{}, nil, deadLetters, &HandlerConfig{})
+	dd.jobs = make(chan *deliveryJob)
+
+	d := &Delivery{Source: "github", Event: "push"}
+	dd.accept(d, `{"full":true}`)
+	if err := dd.enqueue(d, `{"full":true}`); err != errQueueFull {
+		t.Fatalf("expected full queue, got %v", err)
+	}
+
+	kept, err := deadLetters.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 1 || kept[0].DeliveryID != d.ID || kept[0].Error != errQueueFull.Error() {
+		t.Errorf("expected the rejected delivery to be kept as a dead letter: %+v", kept)
+	}
+}
+
+func TestServerRespondsToGithubJSONAsync(t *testing.T) {
+	cfg := *serverTestConfig
+	cfg.Async = true
+	cfg.AsyncWorkers = 2
+	cfg.AsyncQueueSize = 10
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/github-test", getPayloadJSONReader("github", "valid"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", "push")
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+
+	if hr.Code != 202 {
+		t.Fatalf("unexpected status %v: %s", hr.Code, hr.Body.String())
+	}
+
+	accepted := map[string]string{}
+	if err := json.Unmarshal(hr.Body.Bytes(), &accepted); err != nil {
+		t.Fatal(err)
+	}
+	if accepted["id"] == "" || hr.Header().Get("X-Hookworm-Delivery") != accepted["id"] {
+		t.Fatalf("missing delivery id in %+v", accepted)
+	}
+
+	for i := 0; i < 250; i++ {
+		req, _ = http.NewRequest("GET", "/deliveries/"+accepted["id"], nil)
+		hr = httptest.NewRecorder()
+		m.ServeHTTP(hr, req)
+
+		if hr.Code != 200 {
+			t.Fatalf("unexpected status %v: %s", hr.Code, hr.Body.String())
+		}
+
+		d := map[string]interface{}{}
+		if err := json.Unmarshal(hr.Body.Bytes(), &d); err != nil {
+			t.Fatal(err)
+		}
+
+		if d["state"] == deliveryCompleted {
+			return
+		}
+		if d["state"] == deliveryFailed {
+			t.Fatalf("delivery failed: %+v", d)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("delivery never completed")
+}
+
+func TestServerRespondsToUnknownDelivery(t *testing.T) {
+	resp := getResponse("GET", "/deliveries/nope", "", nil)
+	if resp.Code != 404 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
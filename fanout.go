@@ -0,0 +1,249 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sync"
+)
+
+const (
+	mergeFirst = "first"
+	mergeJSON  = "json"
+	mergeOwner = "owner"
+)
+
+var (
+	numericPrefixRegexp = regexp.MustCompile(`^([0-9]+)[-_.]`)
+)
+
+// fanoutHandler is a pipeline stage that sends the same payload to each of
+// its handlers concurrently, then merges their outputs into the payload
+// passed to the next stage
+type fanoutHandler struct {
+	name     string
+	handlers []*shellHandler
+	merge    string
+	owner    *shellHandler
+	next     Handler
+}
+
+type fanoutResult struct {
+	*handlerOutcome
+	err error
+}
+
+func newFanoutHandler(name string, handlers []*shellHandler, merge, owner string) (*fanoutHandler, error) {
+	fh := &fanoutHandler{
+		name:     name,
+		handlers: handlers,
+		merge:    merge,
+	}
+
+	if fh.merge == "" {
+		fh.merge = mergeFirst
+	}
+
+	switch fh.merge {
+	case mergeFirst, mergeJSON:
+	case mergeOwner:
+		for _, sh := range handlers {
+			if owner != "" && (sh.command.filePath == owner || path.Base(sh.command.filePath) == owner) {
+				fh.owner = sh
+			}
+		}
+		if fh.owner == nil {
+			return nil, fmt.Errorf("group %q: owner %q is not one of its handlers", name, owner)
+		}
+	default:
+		return nil, fmt.Errorf("group %q: unknown merge %q", name, merge)
+	}
+
+	return fh, nil
+}
+
+func (fh *fanoutHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	var (
+		wg      sync.WaitGroup
+		results = make([]*fanoutResult, len(fh.handlers))
+	)
+
+	logger.Debugf("Fanning out %s payload to group %q\n", delivery.Source, fh.name)
+
+	for i, sh := range fh.handlers {
+		wg.Add(1)
+		go func(i int, sh *shellHandler) {
+			defer wg.Done()
+			outcome, err := sh.handle(delivery, payload)
+			results[i] = &fanoutResult{handlerOutcome: outcome, err: err}
+		}(i, sh)
+	}
+
+	wg.Wait()
+
+	stop := false
+	for _, result := range results {
+		if result.err != nil {
+			return result.payload, result.err
+		}
+		stop = stop || result.stop
+	}
+
+	out, err := fh.mergeResults(payload, results)
+	if err != nil {
+		return out, err
+	}
+
+	if stop {
+		logger.Printf("Stopping pipeline after group %q for delivery %s\n", fh.name, delivery.ID)
+		return out, nil
+	}
+
+	if fh.next != nil {
+		return fh.next.HandlePayload(delivery, out)
+	}
+
+	return out, nil
+}
+
+// mergeResults combines the outputs of the handlers that handled the
+// payload.  Handlers that were skipped or no-op'd contribute nothing, and
+// the payload passes through unchanged if none handled it.
+func (fh *fanoutHandler) mergeResults(payload string, results []*fanoutResult) (string, error) {
+	switch fh.merge {
+	case mergeOwner:
+		for i, sh := range fh.handlers {
+			if sh == fh.owner && results[i].handled {
+				return results[i].payload, nil
+			}
+		}
+		return payload, nil
+	case mergeJSON:
+		merged := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(payload), &merged); err != nil {
+			merged = map[string]interface{}{}
+		}
+
+		handled := false
+		for i, result := range results {
+			if !result.handled {
+				continue
+			}
+
+			obj := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(result.payload), &obj); err != nil {
+				return result.payload, fmt.Errorf("group %q: output of %v is not a JSON object: %v",
+					fh.name, fh.handlers[i].command.filePath, err)
+			}
+
+			for k, v := range obj {
+				merged[k] = v
+			}
+			handled = true
+		}
+
+		if !handled {
+			return payload, nil
+		}
+
+		out, err := json.Marshal(merged)
+		return string(out), err
+	default:
+		for _, result := range results {
+			if result.handled {
+				return result.payload, nil
+			}
+		}
+		return payload, nil
+	}
+}
+
+func (fh *fanoutHandler) SetNextHandler(n Handler) {
+	fh.next = n
+}
+
+func (fh *fanoutHandler) NextHandler() Handler {
+	return fh.next
+}
+
+// shellHandlers returns the handlers in every stage of the pipeline, in
+// order
+func shellHandlers(pipeline Handler) []*shellHandler {
+	var handlers []*shellHandler
+	for nh := pipeline.NextHandler(); nh != nil; nh = nh.NextHandler() {
+		switch h := nh.(type) {
+		case *shellHandler:
+			handlers = append(handlers, h)
+		case *fanoutHandler:
+			handlers = append(handlers, h.handlers...)
+		}
+	}
+	return handlers
+}
+
+// fanoutGroup returns the name of the concurrent group the handler belongs
+// to, if any.  Shell handlers are grouped explicitly via the manifest, or
+// by numeric file name prefix (e.g. `30-slack.py` and `30-archive.rb`)
+// when fan-out is enabled.  Native handlers always run alone.
+func fanoutGroup(handler Handler, cfg *HandlerConfig) string {
+	sh, ok := handler.(*shellHandler)
+	if !ok {
+		return ""
+	}
+
+	if sh.manifest != nil && sh.manifest.Group != "" {
+		return sh.manifest.Group
+	}
+
+	if !cfg.Fanout {
+		return ""
+	}
+
+	if match := numericPrefixRegexp.FindStringSubmatch(path.Base(sh.command.filePath)); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// buildPipelineStages groups consecutive handlers belonging to the same
+// fan-out group into a single concurrent stage
+func buildPipelineStages(handlers []Handler, groups map[string]*manifestGroup, cfg *HandlerConfig) ([]Handler, error) {
+	var stages []Handler
+
+	for i := 0; i < len(handlers); {
+		group := fanoutGroup(handlers[i], cfg)
+
+		j := i + 1
+		for group != "" && j < len(handlers) && fanoutGroup(handlers[j], cfg) == group {
+			j++
+		}
+
+		if j-i == 1 {
+			stages = append(stages, handlers[i])
+			i = j
+			continue
+		}
+
+		merge, owner := cfg.FanoutMerge, ""
+		if mg, ok := groups[group]; ok {
+			merge, owner = mg.Merge, mg.Owner
+		}
+
+		var members []*shellHandler
+		for _, handler := range handlers[i:j] {
+			members = append(members, handler.(*shellHandler))
+		}
+
+		fh, err := newFanoutHandler(group, members, merge, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		stages = append(stages, fh)
+		i = j
+	}
+
+	return stages, nil
+}
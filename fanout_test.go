@@ -0,0 +1,168 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const fanoutHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+import time
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+
+key = os.environ.get('FAN_KEY', os.path.basename(sys.argv[0]))
+time.sleep(float(os.environ.get('FAN_SLEEP') or 0))
+if os.environ.get('FAN_EXIT'):
+    sys.exit(int(os.environ['FAN_EXIT']))
+
+payload = json.load(sys.stdin)
+payload[key] = True
+json.dump(payload, sys.stdout)
+sys.exit(0)
+`
+
+func setupFanoutWormDir(names []string, manifest string, t *testing.T) (string, *HandlerConfig) {
+	dir := newJournalTestDir(t)
+
+	for _, name := range names {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(fanoutHandlerBody), 0755)
+	}
+
+	if manifest != "" {
+		ioutil.WriteFile(filepath.Join(dir, wormManifestName), []byte(manifest), 0644)
+	}
+
+	return dir, &HandlerConfig{WormDir: dir, WormTimeout: 10}
+}
+
+func handleFanoutPayload(cfg *HandlerConfig, t *testing.T) map[string]interface{} {
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{"input":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(out), &result); err != nil {
+		t.Fatalf("unexpected output %q: %v", out, err)
+	}
+	return result
+}
+
+func TestNumericPrefixFanoutStages(t *testing.T) {
+	dir, cfg := setupFanoutWormDir([]string{"10-a.py", "10-b.py", "20-c.py", "other.py"}, "", t)
+	defer os.RemoveAll(dir)
+
+	pipeline, _ := NewHandlerPipeline(cfg)
+	if _, ok := pipeline.NextHandler().(*shellHandler); !ok {
+		t.Errorf("expected linear pipeline without fan-out")
+	}
+
+	cfg.Fanout = true
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fh, ok := pipeline.NextHandler().(*fanoutHandler)
+	if !ok || fh.name != "10" || len(fh.handlers) != 2 {
+		t.Fatalf("expected fan-out stage, got %#v", pipeline.NextHandler())
+	}
+	if _, ok := fh.NextHandler().(*shellHandler); !ok {
+		t.Errorf("expected single handler stage after fan-out stage")
+	}
+	if len(shellHandlers(pipeline)) != 4 {
+		t.Errorf("unexpected handlers %+v", shellHandlers(pipeline))
+	}
+
+	result := handleFanoutPayload(cfg, t)
+	if result["10-a.py"] != true || result["10-b.py"] != nil || result["20-c.py"] != true || result["other.py"] != true {
+		t.Errorf("unexpected first-wins output %+v", result)
+	}
+}
+
+func TestFanoutRunsConcurrently(t *testing.T) {
+	dir, cfg := setupFanoutWormDir([]string{"10-a.py", "10-b.py", "10-c.py"}, "", t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("FAN_SLEEP", "1")
+	defer os.Setenv("FAN_SLEEP", "")
+
+	cfg.Fanout = true
+	cfg.FanoutMerge = mergeJSON
+
+	start := time.Now()
+	result := handleFanoutPayload(cfg, t)
+	if elapsed := time.Since(start); elapsed > 2500*time.Millisecond {
+		t.Errorf("fan-out stage took %v", elapsed)
+	}
+
+	for _, key := range []string{"input", "10-a.py", "10-b.py", "10-c.py"} {
+		if result[key] != true {
+			t.Errorf("missing %q in merged output %+v", key, result)
+		}
+	}
+}
+
+func TestManifestFanoutGroupOwner(t *testing.T) {
+	dir, cfg := setupFanoutWormDir([]string{"slack.py", "archive.py"}, `{
+  "handlers": [
+    {"command": "slack.py", "group": "notify", "env": {"FAN_KEY": "slack"}},
+    {"command": "archive.py", "group": "notify", "env": {"FAN_KEY": "archive"}}
+  ],
+  "groups": {"notify": {"merge": "owner", "owner": "archive.py"}}
+}`, t)
+	defer os.RemoveAll(dir)
+
+	result := handleFanoutPayload(cfg, t)
+	if result["archive"] != true || result["slack"] != nil {
+		t.Errorf("unexpected owner output %+v", result)
+	}
+}
+
+func TestFanoutFailsWhenAnyHandlerFails(t *testing.T) {
+	dir, cfg := setupFanoutWormDir([]string{"ok.py", "fails.py"}, `{
+  "handlers": [
+    {"command": "ok.py", "group": "g"},
+    {"command": "fails.py", "group": "g", "env": {"FAN_EXIT": "3"}}
+  ]
+}`, t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pipeline.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	if he, ok := err.(*handlerError); !ok || he.ExitStatus != 3 {
+		t.Errorf("expected handler error from failed group member, got %v", err)
+	}
+}
+
+func TestManifestFanoutGroupValidation(t *testing.T) {
+	for _, manifest := range []string{
+		`{"handlers": [{"command": "a.py", "group": "g"}, {"command": "b.py"}, {"command": "c.py", "group": "g"}]}`,
+		`{"handlers": [{"command": "a.py", "group": "g"}], "groups": {"g": {"merge": "owner"}}}`,
+		`{"handlers": [{"command": "a.py", "group": "g"}], "groups": {"g": {"merge": "random"}}}`,
+		`{"handlers": [{"command": "a.py", "group": "g"}, {"command": "b.py", "group": "g"}], "groups": {"g": {"merge": "owner", "owner": "c.py"}}}`,
+	} {
+		dir, cfg := setupFanoutWormDir([]string{"a.py", "b.py", "c.py"}, manifest, t)
+		if _, err := NewHandlerPipeline(cfg); err == nil {
+			t.Errorf("expected %s to be rejected", manifest)
+		}
+		os.RemoveAll(dir)
+	}
+}
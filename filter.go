@@ -0,0 +1,285 @@
+package hookworm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// payloadFilter is a declarative filter on the parsed payload that is
+// evaluated before a handler is run, so that handlers need not be spawned
+// only to decide a payload is none of their business.  Every non-empty list
+// must have a match, and a list that refers to something the payload does
+// not carry never matches.
+type payloadFilter struct {
+	Repos   []string `json:"repos,omitempty"`
+	Refs    []string `json:"refs,omitempty"`
+	Paths   []string `json:"paths,omitempty"`
+	Senders []string `json:"senders,omitempty"`
+	Events  []string `json:"events,omitempty"`
+
+	repos []*regexp.Regexp
+	refs  []*regexp.Regexp
+	paths []*regexp.Regexp
+}
+
+// payloadFacts is what filters know about a payload, gathered from the
+// fields used by each of the supported sources
+type payloadFacts struct {
+	repo   string
+	refs   []string
+	paths  []string
+	sender string
+}
+
+// compile validates the filter's globs, which support `*` and `?` within a
+// single path segment and `**` across segments
+func (pf *payloadFilter) compile() error {
+	var err error
+
+	if pf.repos, err = compileGlobs(pf.Repos, true); err != nil {
+		return fmt.Errorf("invalid repos filter: %v", err)
+	}
+	if pf.refs, err = compileGlobs(pf.Refs, false); err != nil {
+		return fmt.Errorf("invalid refs filter: %v", err)
+	}
+	if pf.paths, err = compileGlobs(pf.Paths, false); err != nil {
+		return fmt.Errorf("invalid paths filter: %v", err)
+	}
+
+	return nil
+}
+
+func (pf *payloadFilter) empty() bool {
+	return len(pf.Repos) == 0 && len(pf.Refs) == 0 && len(pf.Paths) == 0 &&
+		len(pf.Senders) == 0 && len(pf.Events) == 0
+}
+
+// matches is true if the delivery and payload satisfy every part of the
+// filter.  A nil filter matches everything.
+func (pf *payloadFilter) matches(delivery *Delivery, payload string) bool {
+	if pf == nil || pf.empty() {
+		return true
+	}
+
+	if len(pf.Events) > 0 && !containsString(pf.Events, delivery.Event, false) {
+		return false
+	}
+
+	facts := extractPayloadFacts(payload)
+
+	if len(pf.Repos) > 0 && (facts.repo == "" || !matchAnyGlob(pf.repos, facts.repo)) {
+		return false
+	}
+
+	if len(pf.Refs) > 0 && !pf.matchesRef(facts.refs) {
+		return false
+	}
+
+	if len(pf.Paths) > 0 && !pf.matchesPath(facts.paths) {
+		return false
+	}
+
+	if len(pf.Senders) > 0 && (facts.sender == "" || !containsString(pf.Senders, facts.sender, true)) {
+		return false
+	}
+
+	return true
+}
+
+// matchesRef is true if any ref matches, either in full (`refs/heads/master`)
+// or by its short branch or tag name (`master`)
+func (pf *payloadFilter) matchesRef(refs []string) bool {
+	for _, ref := range refs {
+		if matchAnyGlob(pf.refs, ref) {
+			return true
+		}
+
+		for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+			if strings.HasPrefix(ref, prefix) && matchAnyGlob(pf.refs, strings.TrimPrefix(ref, prefix)) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (pf *payloadFilter) matchesPath(paths []string) bool {
+	for _, p := range paths {
+		if matchAnyGlob(pf.paths, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// extractPayloadFacts gathers the repository, refs, changed paths and
+// sender from a GitHub, GitLab, Bitbucket or Travis payload.  Anything that
+// cannot be found is left empty.
+func extractPayloadFacts(payload string) *payloadFacts {
+	facts := &payloadFacts{}
+
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+		return facts
+	}
+
+	facts.repo = firstString(
+		lookupString(obj, "repository", "full_name"),
+		lookupString(obj, "project", "path_with_namespace"),
+		joinNonEmpty(lookupString(obj, "repository", "owner", "login"), lookupString(obj, "repository", "name")),
+		joinNonEmpty(lookupString(obj, "repository", "owner", "name"), lookupString(obj, "repository", "name")),
+		joinNonEmpty(lookupString(obj, "repository", "owner_name"), lookupString(obj, "repository", "name")),
+	)
+
+	if ref := lookupString(obj, "ref"); ref != "" {
+		facts.refs = append(facts.refs, ref)
+	}
+	if branch := firstString(lookupString(obj, "branch"), lookupString(obj, "pull_request", "head", "ref")); branch != "" {
+		facts.refs = append(facts.refs, "refs/heads/"+branch)
+	}
+
+	if push, ok := obj["push"].(map[string]interface{}); ok {
+		changes, _ := push["changes"].([]interface{})
+		for _, change := range changes {
+			changeObj, _ := change.(map[string]interface{})
+			switch name := lookupString(changeObj, "new", "name"); lookupString(changeObj, "new", "type") {
+			case "branch":
+				facts.refs = append(facts.refs, "refs/heads/"+name)
+			case "tag":
+				facts.refs = append(facts.refs, "refs/tags/"+name)
+			}
+		}
+	}
+
+	commits, _ := obj["commits"].([]interface{})
+	for _, commit := range commits {
+		commitObj, _ := commit.(map[string]interface{})
+		for _, key := range []string{"added", "modified", "removed"} {
+			paths, _ := commitObj[key].([]interface{})
+			for _, p := range paths {
+				if s, ok := p.(string); ok {
+					facts.paths = append(facts.paths, s)
+				}
+			}
+		}
+	}
+
+	facts.sender = firstString(
+		lookupString(obj, "sender", "login"),
+		lookupString(obj, "user_username"),
+		lookupString(obj, "actor", "username"),
+		lookupString(obj, "actor", "nickname"),
+		lookupString(obj, "pusher", "name"),
+		lookupString(obj, "author_name"),
+	)
+
+	return facts
+}
+
+func lookupString(obj map[string]interface{}, keys ...string) string {
+	for i, key := range keys {
+		if i == len(keys)-1 {
+			s, _ := obj[key].(string)
+			return s
+		}
+
+		next, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		obj = next
+	}
+
+	return ""
+}
+
+func firstString(candidates ...string) string {
+	for _, s := range candidates {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func joinNonEmpty(owner, name string) string {
+	if owner == "" || name == "" {
+		return ""
+	}
+	return owner + "/" + name
+}
+
+func containsString(list []string, s string, foldCase bool) bool {
+	if s == "" {
+		return false
+	}
+
+	for _, item := range list {
+		if item == s || (foldCase && strings.EqualFold(item, s)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAnyGlob(globs []*regexp.Regexp, s string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func compileGlobs(patterns []string, foldCase bool) ([]*regexp.Regexp, error) {
+	var globs []*regexp.Regexp
+	for _, pattern := range patterns {
+		glob, err := compileGlob(pattern, foldCase)
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+// compileGlob converts a glob into an anchored regexp in which `*` and `?`
+// do not match `/`, `**` matches anything and `**/` matches zero or more
+// leading directories
+func compileGlob(pattern string, foldCase bool) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty pattern")
+	}
+
+	var buf bytes.Buffer
+	if foldCase {
+		buf.WriteString("(?i)")
+	}
+	buf.WriteString("^")
+
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			buf.WriteString("[^/]*")
+		case pattern[i] == '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
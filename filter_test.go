@@ -0,0 +1,173 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const filteredHandlerBody = `#!/usr/bin/env python
+import json
+import sys
+
+if sys.argv[1] == 'configure':
+    json.dump({'filter': {'refs': ['master']}}, sys.stdout)
+    sys.exit(0)
+
+payload = json.load(sys.stdin)
+payload['handled'] = True
+json.dump(payload, sys.stdout)
+sys.exit(0)
+`
+
+func newTestFilter(filter string, t *testing.T) *payloadFilter {
+	pf := &payloadFilter{}
+	if err := json.Unmarshal([]byte(filter), pf); err != nil {
+		t.Fatal(err)
+	}
+	if err := pf.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return pf
+}
+
+func TestExtractPayloadFacts(t *testing.T) {
+	for name, expected := range map[string]*payloadFacts{
+		"github/rogue_unwatched_path": &payloadFacts{
+			repo: "modcloth-labs/hookworm", refs: []string{"refs/heads/master"},
+			paths: []string{"README.md"}, sender: "none",
+		},
+		"gitlab/push": &payloadFacts{
+			repo: "mike/diaspora", refs: []string{"refs/heads/master"}, sender: "jsmith",
+		},
+		"bitbucket/repo_push": &payloadFacts{
+			repo: "modcloth-labs/hookworm", refs: []string{"refs/heads/master"}, sender: "emmap1",
+		},
+	} {
+		parts := strings.Split(name, "/")
+		facts := extractPayloadFacts(getPayload(parts[0], parts[1]))
+
+		if facts.repo != expected.repo || facts.sender != expected.sender ||
+			strings.Join(facts.refs, " ") != strings.Join(expected.refs, " ") {
+			t.Errorf("%s: unexpected facts %+v", name, facts)
+		}
+		if expected.paths != nil && strings.Join(facts.paths, " ") != strings.Join(expected.paths, " ") {
+			t.Errorf("%s: unexpected paths %v", name, facts.paths)
+		}
+	}
+
+	if facts := extractPayloadFacts(`not json`); facts.repo != "" || facts.refs != nil {
+		t.Errorf("unexpected facts for bogus payload %+v", facts)
+	}
+}
+
+func TestPayloadFilterMatches(t *testing.T) {
+	github := &Delivery{Source: "github", Event: "push"}
+
+	for filter, expected := range map[string]map[string]bool{
+		`{"refs": ["master"]}`: {
+			"rogue": true, "rogue_unwatched_branch": false,
+		},
+		`{"refs": ["refs/heads/still-*"]}`: {
+			"rogue": false, "rogue_unwatched_branch": true,
+		},
+		`{"paths": ["**/*.go", "Makefile"]}`: {
+			"rogue": true, "rogue_unwatched_path": false,
+		},
+		`{"repos": ["MODCLOTH-LABS/*"], "events": ["push"]}`: {
+			"rogue": true, "rogue_unwatched_path": true,
+		},
+		`{"repos": ["someone-else/*"]}`: {
+			"rogue": false,
+		},
+		`{"senders": ["nobody"]}`: {
+			"rogue": false,
+		},
+		`{"events": ["pull_request"]}`: {
+			"rogue": false,
+		},
+	} {
+		pf := newTestFilter(filter, t)
+		for name, match := range expected {
+			if pf.matches(github, getPayload("github", name)) != match {
+				t.Errorf("%s: expected match of %s to be %v", filter, name, match)
+			}
+		}
+	}
+
+	var nilFilter *payloadFilter
+	if !nilFilter.matches(github, `{}`) {
+		t.Errorf("expected nil filter to match")
+	}
+
+	if newTestFilter(`{"refs": ["master"]}`, t).matches(github, `{}`) {
+		t.Errorf("expected filter on missing ref not to match")
+	}
+}
+
+func TestCompileGlob(t *testing.T) {
+	for pattern, expected := range map[string]map[string]bool{
+		"*.go":          {"main.go": true, "cmd/main.go": false},
+		"**/*.go":       {"main.go": true, "cmd/main.go": true, "main.rb": false},
+		"docs/**":       {"docs/a/b.md": true, "src/docs/a.md": false},
+		"release-?.[0]": {"release-1.[0]": true, "release-10.[0]": false},
+	} {
+		glob, err := compileGlob(pattern, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for s, match := range expected {
+			if glob.MatchString(s) != match {
+				t.Errorf("%q: expected match of %q to be %v", pattern, s, match)
+			}
+		}
+	}
+
+	if _, err := compileGlob("", false); err == nil {
+		t.Errorf("expected empty pattern to be rejected")
+	}
+}
+
+func TestFilteredHandlersAreNotRun(t *testing.T) {
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    {"command": "20-fails.py", "filter": {"paths": ["**/*.go"]}},
+    {"command": "argv.py", "enabled": false},
+    {"command": "10-argv.py", "enabled": false}
+  ]
+}`, t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "filtered.py"), []byte(filteredHandlerBody), 0755)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := getPayload("github", "rogue_unwatched_path")
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github", Event: "push"}, payload)
+	if err != nil {
+		t.Fatalf("expected failing handler to be filtered out, got %v", err)
+	}
+	if !strings.Contains(out, `"handled"`) {
+		t.Errorf("expected declared filter to match master, got %s", out)
+	}
+
+	payload = getPayload("github", "rogue_unwatched_branch")
+	if _, err := pipeline.HandlePayload(&Delivery{Source: "github", Event: "push"}, payload); err == nil {
+		t.Errorf("expected failing handler to run for matching paths")
+	}
+}
+
+func TestLoadWormManifestRejectsInvalidFilter(t *testing.T) {
+	dir, cfg := setupManifestWormDir(`{"handlers": [{"command": "argv.py", "filter": {"refs": [""]}}]}`, t)
+	defer os.RemoveAll(dir)
+
+	if _, err := NewHandlerPipeline(cfg); err == nil {
+		t.Errorf("expected empty ref pattern to be rejected")
+	}
+}
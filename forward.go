@@ -0,0 +1,153 @@
+package hookworm
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// unforwardedHeaders are request headers that are not copied from the
+	// original delivery, either because they describe the original request
+	// rather than the payload or because they would no longer be valid
+	unforwardedHeaders = []string{
+		"Accept-Encoding",
+		"Connection",
+		"Content-Length",
+		"Content-Type",
+		"Host",
+		"Signature",
+		"Transfer-Encoding",
+		"X-Hub-Signature",
+		"X-Hub-Signature-256",
+	}
+)
+
+// forwarder relays payloads to a downstream service by POSTing them to a
+// URL, and is configured via the `forward` key of a worm manifest entry
+type forwarder struct {
+	URL       string            `json:"url"`
+	Secret    string            `json:"secret"`
+	SecretEnv string            `json:"secret_env"`
+	Headers   map[string]string `json:"headers"`
+}
+
+// forwardError describes a downstream service that could not be reached or
+// responded with an unsuccessful status
+type forwardError struct {
+	status    int
+	transient bool
+	err       error
+}
+
+func (e *forwardError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("downstream responded %d %s", e.status, http.StatusText(e.status))
+}
+
+func (f *forwarder) validate() error {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return fmt.Errorf("invalid forward url %q: %v", f.URL, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid forward url %q: must be an absolute http or https url", f.URL)
+	}
+
+	if f.Secret != "" && f.SecretEnv != "" {
+		return fmt.Errorf("forward secret and secret_env are mutually exclusive")
+	}
+
+	return nil
+}
+
+func (f *forwarder) secret() string {
+	if f.SecretEnv != "" {
+		return os.Getenv(f.SecretEnv)
+	}
+	return f.Secret
+}
+
+// forward POSTs the payload along with the original delivery's headers,
+// re-signing it if there is a secret.  The response body of a 200 becomes
+// the new payload, and any other 2xx passes the payload along unchanged.
+// Timeouts, connection failures, 408, 429 and 5xx responses are transient.
+// The start of the response body is returned in place of standard error.
+// No more of the response body than one byte past maxSize is read.
+func (f *forwarder) forward(delivery *Delivery, payload string, timeout, maxSize int) (*handlerOutput, error) {
+	output := &handlerOutput{}
+
+	req, err := http.NewRequest("POST", f.URL, strings.NewReader(payload))
+	if err != nil {
+		return output, err
+	}
+
+	for k, v := range delivery.Headers {
+		req.Header[k] = v
+	}
+
+	for _, k := range unforwardedHeaders {
+		req.Header.Del(k)
+	}
+
+	req.Header.Set("Content-Type", ctypeJSON)
+	req.Header.Set("X-Hookworm-Delivery", delivery.ID)
+	req.Header.Set("X-Hookworm-Source", delivery.Source)
+	if delivery.Event != "" {
+		req.Header.Set("X-Hookworm-Event", delivery.Event)
+	}
+
+	for k, v := range f.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if secret := f.secret(); secret != "" {
+		signHubPayload(secret, []byte(payload), githubSignatureHeaders, req.Header)
+	}
+
+	client := &http.Client{}
+	if timeout > 0 {
+		client.Timeout = time.Duration(timeout) * time.Second
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return output, &exitTimeout{timeout: timeout}
+		}
+		return output, &forwardError{transient: true, err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := readBounded(resp.Body, maxSize)
+	if err != nil {
+		return output, &forwardError{status: resp.StatusCode, transient: true, err: err}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK && len(strings.TrimSpace(string(body))) > 0:
+		output.out = body
+		return output, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		output.out = []byte(payload)
+		return output, nil
+	}
+
+	if len(body) > stderrTailSize {
+		body = body[:stderrTailSize]
+	}
+	output.stderr = body
+
+	return output, &forwardError{
+		status: resp.StatusCode,
+		transient: resp.StatusCode == http.StatusRequestTimeout ||
+			resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500,
+	}
+}
@@ -0,0 +1,207 @@
+package hookworm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+type forwardTestServer struct {
+	*httptest.Server
+	requests []*http.Request
+	bodies   []string
+	statuses []int
+	response string
+}
+
+func newForwardTestServer(response string, statuses ...int) *forwardTestServer {
+	fts := &forwardTestServer{response: response, statuses: statuses}
+	fts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fts.requests = append(fts.requests, r)
+		fts.bodies = append(fts.bodies, string(body))
+
+		status := http.StatusOK
+		if len(fts.statuses) > 0 {
+			status, fts.statuses = fts.statuses[0], fts.statuses[1:]
+		}
+
+		w.WriteHeader(status)
+		fmt.Fprint(w, fts.response)
+	}))
+	return fts
+}
+
+func newForwardTestPipeline(entry string, t *testing.T) (string, Handler) {
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    `+entry+`,
+    {"command": "argv.py", "enabled": false},
+    {"command": "10-argv.py", "enabled": false},
+    {"command": "20-fails.py", "enabled": false}
+  ]
+}`, t)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return dir, pipeline
+}
+
+func TestForwardHandlerRelaysPayload(t *testing.T) {
+	fts := newForwardTestServer(`{"relayed":true}`)
+	defer fts.Close()
+
+	os.Setenv("HOOKWORM_TEST_FORWARD_SECRET", "sekrit")
+	defer os.Setenv("HOOKWORM_TEST_FORWARD_SECRET", "")
+
+	dir, pipeline := newForwardTestPipeline(`{"forward": {
+    "url": "`+fts.URL+`/hooks",
+    "secret_env": "HOOKWORM_TEST_FORWARD_SECRET",
+    "headers": {"Authorization": "Bearer abc"}
+  }}`, t)
+	defer os.RemoveAll(dir)
+
+	delivery := &Delivery{
+		ID:     "abc-123",
+		Source: "github",
+		Event:  "push",
+		Headers: http.Header{
+			"X-Github-Event":      {"push"},
+			"X-Hub-Signature-256": {"sha256=stale"},
+			"User-Agent":          {"GitHub-Hookshot/123"},
+		},
+	}
+
+	out, err := pipeline.HandlePayload(delivery, `{"ok":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `{"relayed":true}` {
+		t.Errorf("expected response body to become the payload, got %q", out)
+	}
+
+	if len(fts.requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(fts.requests))
+	}
+
+	req := fts.requests[0]
+	if req.URL.Path != "/hooks" || fts.bodies[0] != `{"ok":true}` {
+		t.Errorf("unexpected request %v %q", req.URL, fts.bodies[0])
+	}
+
+	for header, expected := range map[string]string{
+		"X-Github-Event":      "push",
+		"User-Agent":          "GitHub-Hookshot/123",
+		"Authorization":       "Bearer abc",
+		"X-Hookworm-Delivery": "abc-123",
+		"X-Hookworm-Source":   "github",
+		"X-Hookworm-Event":    "push",
+	} {
+		if actual := req.Header.Get(header); actual != expected {
+			t.Errorf("%s: expected %q, got %q", header, expected, actual)
+		}
+	}
+
+	req.Body = ioutil.NopCloser(strings.NewReader(fts.bodies[0]))
+	if err := verifyGithubSignature("sekrit", req); err != nil {
+		t.Errorf("expected re-signed payload: %v", err)
+	}
+}
+
+func TestForwardHandlerResponses(t *testing.T) {
+	for _, status := range []int{http.StatusAccepted, http.StatusNoContent} {
+		fts := newForwardTestServer(`ignored`, status)
+		dir, pipeline := newForwardTestPipeline(`{"forward": {"url": "`+fts.URL+`"}}`, t)
+
+		out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{"ok":true}`)
+		if err != nil || out != `{"ok":true}` {
+			t.Errorf("%d: expected payload to pass through, got %q %v", status, out, err)
+		}
+
+		fts.Close()
+		os.RemoveAll(dir)
+	}
+
+	fts := newForwardTestServer(`no such thing`, http.StatusNotFound)
+	defer fts.Close()
+
+	dir, pipeline := newForwardTestPipeline(`{"forward": {"url": "`+fts.URL+`"}, "retry": {"max_attempts": 3}}`, t)
+	defer os.RemoveAll(dir)
+
+	_, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	he, ok := err.(*handlerError)
+	if !ok || he.Stderr != "no such thing" || !strings.Contains(he.Error(), "404") {
+		t.Errorf("expected downstream failure, got %#v", err)
+	}
+	if len(fts.requests) != 1 {
+		t.Errorf("expected 404 not to be retried, got %d requests", len(fts.requests))
+	}
+}
+
+func TestForwardHandlerRetriesTransientFailures(t *testing.T) {
+	fts := newForwardTestServer(`{"third":"time"}`, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer fts.Close()
+
+	dir, pipeline := newForwardTestPipeline(`{"forward": {"url": "`+fts.URL+`"},
+    "retry": {"max_attempts": 3, "initial_delay": 0.01}}`, t)
+	defer os.RemoveAll(dir)
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	if err != nil || out != `{"third":"time"}` || len(fts.requests) != 3 {
+		t.Errorf("expected transient failures to be retried, got %q %v after %d requests", out, err, len(fts.requests))
+	}
+
+	if !isTransient(&forwardError{transient: true}) || isTransient(&forwardError{status: 400}) {
+		t.Errorf("unexpected transience of forward errors")
+	}
+}
+
+func TestManifestRejectsInvalidForward(t *testing.T) {
+	for _, manifest := range []string{
+		`{"handlers": [{"forward": {"url": "ftp://example.org/"}}]}`,
+		`{"handlers": [{"forward": {"url": "/relative"}}]}`,
+		`{"handlers": [{"forward": {"url": "http://example.org/", "secret": "a", "secret_env": "B"}}]}`,
+		`{"handlers": [{"forward": {"url": "http://example.org/"}, "command": "argv.py"}]}`,
+		`{"handlers": [{"forward": {"url": "http://example.org/"}, "persistent": true}]}`,
+	} {
+		dir, cfg := setupManifestWormDir(manifest, t)
+		if _, err := NewHandlerPipeline(cfg); err == nil {
+			t.Errorf("expected %s to be rejected", manifest)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestForwardHandlerInFanoutGroup(t *testing.T) {
+	fts := newForwardTestServer(`{"downstream":true}`)
+	defer fts.Close()
+
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    {"command": "argv.py", "group": "g"},
+    {"forward": {"url": "`+fts.URL+`"}, "group": "g"},
+    {"command": "10-argv.py", "enabled": false},
+    {"command": "20-fails.py", "enabled": false}
+  ],
+  "groups": {"g": {"merge": "json"}}
+}`, t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github", Event: "push"}, `{}`)
+	if err != nil || !strings.Contains(out, `"downstream":true`) || !strings.Contains(out, `"seen"`) {
+		t.Errorf("expected forward to run alongside shell handler, got %q %v", out, err)
+	}
+}
@@ -1,31 +1,59 @@
 package hookworm
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"path/filepath"
 	"sort"
 	"strings"
 )
 
 // HandlerConfig contains the bag of configuration poo used by all handlers
 type HandlerConfig struct {
-	Debug         bool         `json:"debug"`
-	GithubPath    string       `json:"github_path"`
-	ServerAddress string       `json:"server_address"`
-	ServerPidFile string       `json:"server_pid_file"`
-	StaticDir     string       `json:"static_dir"`
-	TravisPath    string       `json:"travis_path"`
-	WorkingDir    string       `json:"working_dir"`
-	WormDir       string       `json:"worm_dir"`
-	WormTimeout   int          `json:"worm_timeout"`
-	WormFlags     *wormFlagMap `json:"worm_flags"`
-	Version       string       `json:"version"`
+	Async            bool              `json:"async"`
+	AsyncQueueSize   int               `json:"async_queue_size"`
+	AsyncWorkers     int               `json:"async_workers"`
+	BitbucketPath    string            `json:"bitbucket_path"`
+	BitbucketSecret  string            `json:"-"`
+	ConfigureTimeout int               `json:"configure_timeout"`
+	DataDir          string            `json:"data_dir"`
+	Debug            bool              `json:"debug"`
+	Fanout           bool              `json:"fanout"`
+	FanoutMerge      string            `json:"fanout_merge"`
+	Handlers         []string          `json:"handlers"`
+	GithubPath       string            `json:"github_path"`
+	GithubSecret     string            `json:"-"`
+	GitlabPath       string            `json:"gitlab_path"`
+	GitlabSecret     string            `json:"-"`
+	Interpreters     map[string]string `json:"interpreters"`
+	Limits           ResourceLimits    `json:"limits"`
+	Output           *OutputPolicy     `json:"output"`
+	Retry            *RetryPolicy      `json:"retry"`
+	Sandbox          *SandboxProfile   `json:"sandbox"`
+	ServerAddress    string            `json:"server_address"`
+	ServerPidFile    string            `json:"server_pid_file"`
+	Sources          map[string]string `json:"sources"`
+	StaticDir        string            `json:"static_dir"`
+	StderrKeep       int               `json:"stderr_keep"`
+	Strict           bool              `json:"strict"`
+	TravisPath       string            `json:"travis_path"`
+	TravisPubkey     string            `json:"travis_pubkey"`
+	WorkerHealth     int               `json:"worker_health"`
+	WorkingDir       string            `json:"working_dir"`
+	WormDir          string            `json:"worm_dir"`
+	WormKillGrace    int               `json:"worm_kill_grace"`
+	WormReload       int               `json:"worm_reload"`
+	WormTimeout      int               `json:"worm_timeout"`
+	WormFlags        *wormFlagMap      `json:"worm_flags"`
+	Version          string            `json:"version"`
 }
 
-// Handler is the interface each pipeline handler must fulfill
+// Handler is the interface each pipeline handler must fulfill.  The
+// delivery's Source names the endpoint that received the payload, e.g.
+// "github", "travis", or any configured extra source.
 type Handler interface {
-	HandleGithubPayload(string) (string, error)
-	HandleTravisPayload(string) (string, error)
+	HandlePayload(*Delivery, string) (string, error)
 	SetNextHandler(Handler)
 	NextHandler() Handler
 }
@@ -47,21 +75,59 @@ func NewHandlerPipeline(cfg *HandlerConfig) (Handler, error) {
 		}
 	}
 
+	if len(cfg.Handlers) > 0 {
+		err = loadRegisteredHandlers(pipeline, cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return pipeline, nil
 }
 
+// loadRegisteredHandlers appends the native handlers named in the config
+// to the end of the pipeline
+func loadRegisteredHandlers(pipeline Handler, cfg *HandlerConfig) error {
+	curHandler := pipeline
+	for curHandler.NextHandler() != nil {
+		curHandler = curHandler.NextHandler()
+	}
+
+	for _, name := range cfg.Handlers {
+		handler, err := newRegisteredHandler(name, cfg)
+		if err != nil {
+			return err
+		}
+
+		logger.Debugf("Adding native handler %q\n", name)
+
+		curHandler.SetNextHandler(handler)
+		curHandler = handler
+	}
+
+	return nil
+}
+
 func loadShellHandlersFromWormDir(pipeline Handler, cfg *HandlerConfig) error {
 	var (
 		err        error
 		collection []string
 		directory  *os.File
+		manifest   *wormManifest
+		handlers   []Handler
+		listed     = map[string]bool{wormManifestName: true}
 	)
 
+	for _, name := range yamlManifestNames {
+		listed[name] = true
+	}
+
 	if directory, err = os.Open(cfg.WormDir); err != nil {
 		logger.Printf("The worm dir was not able to be opened: %v", err)
 		logger.Printf("This should be the abs path to the worm dir: %v", cfg.WormDir)
 		return err
 	}
+	defer directory.Close()
 
 	if collection, err = directory.Readdirnames(-1); err != nil {
 		logger.Printf("Could not read the file names from the directory: %v", err)
@@ -70,7 +136,47 @@ func loadShellHandlersFromWormDir(pipeline Handler, cfg *HandlerConfig) error {
 
 	sort.Strings(collection)
 
-	curHandler := pipeline
+	if manifest, err = loadWormManifest(cfg.WormDir); err != nil {
+		return err
+	}
+
+	if manifest != nil {
+		logger.Debugf("Using worm manifest with %d handlers\n", len(manifest.Handlers))
+
+		for _, mh := range manifest.Handlers {
+			if mh.Handler != "" {
+				if !mh.enabled() {
+					logger.Printf("Ignoring disabled native handler %q\n", mh.Handler)
+					continue
+				}
+
+				handler, err := newRegisteredHandler(mh.Handler, cfg)
+				if err != nil {
+					return err
+				}
+
+				handlers = append(handlers, handler)
+				continue
+			}
+
+			fullpath := mh.path(cfg.WormDir)
+			if rel, err := filepath.Rel(cfg.WormDir, fullpath); err == nil && mh.Forward == nil {
+				listed[rel] = true
+			}
+
+			if !mh.enabled() {
+				logger.Printf("Ignoring disabled handler %v\n", fullpath)
+				continue
+			}
+
+			sh, err := newManifestShellHandler(mh, cfg)
+			if err != nil {
+				return fmt.Errorf("failed to build shell handler for %v: %v", fullpath, err)
+			}
+
+			handlers = append(handlers, sh)
+		}
+	}
 
 	for _, name := range collection {
 		if strings.HasPrefix(name, ".") {
@@ -78,19 +184,45 @@ func loadShellHandlersFromWormDir(pipeline Handler, cfg *HandlerConfig) error {
 			continue
 		}
 
+		if listed[name] {
+			continue
+		}
+
 		fullpath := path.Join(cfg.WormDir, name)
 		sh, err := newShellHandler(fullpath, cfg)
 
 		if err != nil {
-			logger.Printf("Failed to build shell handler for %v, skipping.: %v\n",
-				fullpath, err)
+			logger.Printf("ERROR: rejecting handler %v: %v\n", fullpath, err)
 			continue
 		}
 
-		logger.Debugf("Adding shell handler for %v\n", fullpath)
+		handlers = append(handlers, sh)
+	}
+
+	var groups map[string]*manifestGroup
+	if manifest != nil {
+		groups = manifest.Groups
+	}
+
+	stages, err := buildPipelineStages(handlers, groups, cfg)
+	if err != nil {
+		return err
+	}
+
+	curHandler := pipeline
+
+	for _, stage := range stages {
+		switch h := stage.(type) {
+		case *fanoutHandler:
+			logger.Debugf("Adding fan-out stage %q with %d handlers\n", h.name, len(h.handlers))
+		case *shellHandler:
+			logger.Debugf("Adding shell handler for %v\n", h.command.filePath)
+		default:
+			logger.Debugf("Adding native handler %T\n", h)
+		}
 
-		curHandler.SetNextHandler(sh)
-		curHandler = sh
+		curHandler.SetNextHandler(stage)
+		curHandler = stage
 	}
 
 	logger.Debugf("Current pipeline: %#v\n", pipeline)
@@ -7,5 +7,15 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == hookworm.LimitShimCommand {
+		os.Exit(hookworm.LimitShimMain(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "dead-letters" {
+		os.Exit(hookworm.DeadLettersMain(os.Args[2:]))
+	}
+
+	hookworm.EnableLimitShim()
+
 	os.Exit(hookworm.ServerMain(nil))
 }
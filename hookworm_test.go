@@ -1,6 +1,7 @@
 package hookworm
 
 import (
+	"os"
 	"testing"
 )
 
@@ -13,6 +14,21 @@ var (
 	}
 )
 
+// TestMain runs the test binary as the limit shim when asked to, just as
+// hookworm-server does, which is why the fixtures are set up here rather
+// than in init functions that the shim would run too
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == LimitShimCommand {
+		os.Exit(LimitShimMain(os.Args[2:]))
+	}
+
+	EnableLimitShim()
+	setupTravisTestKey()
+	setupServerTest()
+	setupTestHandlers()
+	os.Exit(m.Run())
+}
+
 func TestAbbreviatedContentType(t *testing.T) {
 	for before, after := range ctypesAbbrs {
 		if abbrCtype(before) != after {
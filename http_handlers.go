@@ -9,6 +9,7 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/codegangsta/martini"
 	"github.com/codegangsta/martini-contrib/render"
 )
 
@@ -47,6 +48,22 @@ var (
           <input type="submit" value="POST" />
         </form>
       </section>
+      <section id="bitbucket_test">
+        <h2>bitbucket test</h2>
+        <form name="bitbucket" action="{{.BitbucketPath}}" method="post">
+          <textarea name="payload" cols="80" rows="20"
+                    placeholder="bitbucket payload JSON here"></textarea>
+          <input type="submit" value="POST" />
+        </form>
+      </section>
+      <section id="gitlab_test">
+        <h2>gitlab test</h2>
+        <form name="gitlab" action="{{.GitlabPath}}" method="post">
+          <textarea name="payload" cols="80" rows="20"
+                    placeholder="gitlab payload JSON here"></textarea>
+          <input type="submit" value="POST" />
+        </form>
+      </section>
       <section id="travis_test">
         <h2>travis test</h2>
         <form name="travis" action="{{.TravisPath}}" method="post">
@@ -55,6 +72,16 @@ var (
           <input type="submit" value="POST" />
         </form>
       </section>
+      {{range $name, $path := .Sources}}
+      <section id="{{$name}}_test">
+        <h2>{{$name}} test</h2>
+        <form name="{{$name}}" action="{{$path}}" method="post">
+          <textarea name="payload" cols="80" rows="20"
+                    placeholder="{{$name}} payload JSON here"></textarea>
+          <input type="submit" value="POST" />
+        </form>
+      </section>
+      {{end}}
     </article>
   </body>
 </html>
@@ -70,11 +97,13 @@ var (
 )
 
 const (
-	boomExplosionsJSON = `{"error":"BOOM EXPLOSIONS"}`
-	ctypeText          = "text/plain; charset=utf-8"
-	ctypeJSON          = "application/json; charset=utf-8"
-	ctypeHTML          = "text/html; charset=utf-8"
-	ctypeIcon          = "image/vnd.microsoft.icon"
+	boomExplosionsJSON   = `{"error":"BOOM EXPLOSIONS"}`
+	noDeadLettersJSON    = `{"error":"dead letters are only kept when a data directory is given"}`
+	noSuchDeadLetterJSON = `{"error":"no such dead letter"}`
+	ctypeText            = "text/plain; charset=utf-8"
+	ctypeJSON            = "application/json; charset=utf-8"
+	ctypeHTML            = "text/html; charset=utf-8"
+	ctypeIcon            = "image/vnd.microsoft.icon"
 
 	hookwormFaviconBase64 = `
 AAABAAEAEBAQAAAAAAAoAQAAFgAAACgAAAAQAAAAIAAAAAEABAAAAAAAgAAAAAAAAAAAAAAAEAAAAAAA
@@ -86,10 +115,13 @@ AAAAAAAAAAAAAAAAAAAAAAAA`
 )
 
 type testFormContext struct {
-	GithubPath  string
-	TravisPath  string
-	ProgVersion string
-	Debug       bool
+	BitbucketPath string
+	GithubPath    string
+	GitlabPath    string
+	TravisPath    string
+	Sources       map[string]string
+	ProgVersion   string
+	Debug         bool
 }
 
 func init() {
@@ -107,10 +139,13 @@ func handleTestPage(cfg *HandlerConfig, w http.ResponseWriter) (int, string) {
 	var bodyBuf bytes.Buffer
 
 	err := testFormHTML.Execute(&bodyBuf, &testFormContext{
-		GithubPath:  strings.TrimLeft(cfg.GithubPath, "/"),
-		TravisPath:  strings.TrimLeft(cfg.TravisPath, "/"),
-		ProgVersion: progVersion(),
-		Debug:       cfg.Debug,
+		BitbucketPath: strings.TrimLeft(cfg.BitbucketPath, "/"),
+		GithubPath:    strings.TrimLeft(cfg.GithubPath, "/"),
+		GitlabPath:    strings.TrimLeft(cfg.GitlabPath, "/"),
+		TravisPath:    strings.TrimLeft(cfg.TravisPath, "/"),
+		Sources:       trimmedSourcePaths(cfg.Sources),
+		ProgVersion:   progVersion(),
+		Debug:         cfg.Debug,
 	})
 	if err != nil {
 		status = http.StatusInternalServerError
@@ -124,38 +159,98 @@ func handleTestPage(cfg *HandlerConfig, w http.ResponseWriter) (int, string) {
 	return status, body
 }
 
+func trimmedSourcePaths(sources map[string]string) map[string]string {
+	trimmed := map[string]string{}
+	for name, sourcePath := range sources {
+		trimmed[name] = strings.TrimLeft(sourcePath, "/")
+	}
+	return trimmed
+}
+
 func handleConfig(cfg *HandlerConfig, r render.Render) {
 	r.JSON(http.StatusOK, cfg)
 }
 
-func handleGithubPayload(pipeline Handler, l *hookwormLogger, r *http.Request) (int, string) {
-	return handlePayload("github", pipeline, l, r)
+func handleHandlers(pipeline Handler, r render.Render) {
+	r.JSON(http.StatusOK, handlerStatuses(shellHandlers(pipeline)))
+}
+
+func handleGithubPayload(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
+	delivery := &Delivery{
+		SourceID: r.Header.Get("X-GitHub-Delivery"),
+		Source:   "github",
+		Event:    r.Header.Get("X-GitHub-Event"),
+	}
+	return handlePayload(delivery, dd, l, w, r)
+}
+
+func handleBitbucketPayload(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
+	sourceID := r.Header.Get("X-Request-UUID")
+	if sourceID == "" {
+		sourceID = r.Header.Get("X-Request-Id")
+	}
+
+	delivery := &Delivery{
+		SourceID: sourceID,
+		Source:   "bitbucket",
+		Event:    r.Header.Get("X-Event-Key"),
+	}
+	return handlePayload(delivery, dd, l, w, r)
+}
+
+func handleGitlabPayload(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
+	delivery := &Delivery{
+		SourceID: r.Header.Get("X-Gitlab-Event-UUID"),
+		Source:   "gitlab",
+		Event:    r.Header.Get("X-Gitlab-Event"),
+	}
+	return handlePayload(delivery, dd, l, w, r)
 }
 
-func handleTravisPayload(pipeline Handler, l *hookwormLogger, r *http.Request) (int, string) {
-	return handlePayload("travis", pipeline, l, r)
+func handleTravisPayload(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
+	return handlePayload(&Delivery{Source: "travis"}, dd, l, w, r)
 }
 
-func handlePayload(which string, pipeline Handler, l *hookwormLogger, r *http.Request) (int, string) {
+// sourcePayloadHandler returns a martini handler for payloads received from
+// the extra source of the given name
+func sourcePayloadHandler(name string) func(*deliveryDispatcher, *hookwormLogger, http.ResponseWriter, *http.Request) (int, string) {
+	return func(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
+		return handlePayload(&Delivery{Source: name}, dd, l, w, r)
+	}
+}
+
+func handlePayload(delivery *Delivery, dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter, r *http.Request) (int, string) {
 	status, payload, err := prepPayloadForPipeline(l, r)
 	if err != nil {
 		return status, payload
 	}
 
-	if pipeline == nil {
+	if dd.pipeline == nil {
 		status, payload := reportNoPipeline(l)
 		return status, payload
 	}
 
-	l.Debugf("Sending %s payload down pipeline: %+v\n", which, payload)
+	delivery.Headers = journaledHeaders(r.Header)
+	return dispatchDelivery(delivery, payload, dd, l, w)
+}
+
+// dispatchDelivery accepts the delivery and sends it down the pipeline,
+// or queues it when running in async mode
+func dispatchDelivery(delivery *Delivery, payload string, dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter) (int, string) {
+	if err := dd.accept(delivery, payload); err != nil {
+		return handlePayloadErrors(err)
+	}
+
+	w.Header().Set("X-Hookworm-Delivery", delivery.ID)
 
-	if which == "github" {
-		_, err = pipeline.HandleGithubPayload(payload)
-	} else if which == "travis" {
-		_, err = pipeline.HandleTravisPayload(payload)
+	if dd.async() {
+		l.Debugf("Queueing %s payload: %+v %+v\n", delivery.Source, delivery, payload)
+		return handleQueueErrors(delivery, dd.enqueue(delivery, payload))
 	}
 
-	return handlePayloadErrors(err)
+	l.Debugf("Sending %s payload down pipeline: %+v %+v\n", delivery.Source, delivery, payload)
+
+	return handlePayloadErrors(dd.process(delivery, payload))
 }
 
 func prepPayloadForPipeline(l *hookwormLogger, r *http.Request) (int, string, error) {
@@ -183,7 +278,153 @@ func handlePayloadErrors(err error) (int, string) {
 	return http.StatusNoContent, ""
 }
 
+func handleQueueErrors(delivery *Delivery, err error) (int, string) {
+	if err != nil {
+		errJSON, err := json.Marshal(map[string]string{"id": delivery.ID, "error": err.Error()})
+		if err != nil {
+			return http.StatusServiceUnavailable, boomExplosionsJSON
+		}
+		return http.StatusServiceUnavailable, string(errJSON)
+	}
+
+	idJSON, err := json.Marshal(map[string]string{"id": delivery.ID})
+	if err != nil {
+		return http.StatusInternalServerError, boomExplosionsJSON
+	}
+	return http.StatusAccepted, string(idJSON)
+}
+
+func handleDeliveries(dd *deliveryDispatcher, r render.Render) {
+	r.JSON(http.StatusOK, dd.store.list())
+}
+
+func handleDelivery(dd *deliveryDispatcher, params martini.Params, r render.Render) {
+	delivery := dd.store.get(params["id"])
+	if delivery == nil {
+		r.JSON(http.StatusNotFound, map[string]string{"error": "no such delivery"})
+		return
+	}
+
+	r.JSON(http.StatusOK, delivery)
+}
+
 func reportNoPipeline(l *hookwormLogger) (int, string) {
 	l.Debugf("No pipeline present, so doing nothing.\n")
 	return http.StatusNoContent, ""
 }
+
+func handleDeadLetters(dd *deliveryDispatcher, l *hookwormLogger, w http.ResponseWriter) (int, string) {
+	if dd.deadLetters == nil {
+		return http.StatusNotFound, noDeadLettersJSON
+	}
+
+	deadLetters, err := dd.deadLetters.list()
+	if err != nil {
+		l.Printf("ERROR: failed to list dead letters: %v\n", err)
+		return http.StatusInternalServerError, boomExplosionsJSON
+	}
+
+	return renderDeadLetterJSON(deadLetters, w)
+}
+
+func handleDeadLetter(dd *deliveryDispatcher, l *hookwormLogger, params martini.Params, w http.ResponseWriter) (int, string) {
+	dl, status, body := getDeadLetter(dd, l, params["id"])
+	if dl == nil {
+		return status, body
+	}
+
+	return renderDeadLetterJSON(dl, w)
+}
+
+// handleRequeueDeadLetter removes the dead letter and dispatches its payload
+// again as a new delivery
+func handleRequeueDeadLetter(dd *deliveryDispatcher, l *hookwormLogger, params martini.Params, w http.ResponseWriter) (int, string) {
+	dl, status, body := getDeadLetter(dd, l, params["id"])
+	if dl == nil {
+		return status, body
+	}
+
+	l.Printf("Requeueing dead letter %s (%s %s)\n", dl.ID, dl.Source, dl.Event)
+
+	delivery := &Delivery{
+		SourceID: dl.SourceID,
+		Source:   dl.Source,
+		Event:    dl.Event,
+		Headers:  dl.Headers,
+	}
+
+	// the dead letter is only removed once the delivery has been accepted
+	// and queued, so that the payload is not lost if either fails
+	if err := dd.accept(delivery, dl.Payload); err != nil {
+		l.Printf("Keeping dead letter %s, which could not be requeued: %v\n", dl.ID, err)
+		return handlePayloadErrors(err)
+	}
+
+	w.Header().Set("X-Hookworm-Delivery", delivery.ID)
+
+	if dd.async() {
+		if err := dd.offer(delivery, dl.Payload); err != nil {
+			l.Printf("Keeping dead letter %s, which could not be requeued: %v\n", dl.ID, err)
+			return handleQueueErrors(delivery, err)
+		}
+	}
+
+	if _, err := dd.deadLetters.remove(dl.ID); err != nil {
+		l.Printf("ERROR: failed to remove requeued dead letter %s: %v\n", dl.ID, err)
+	}
+
+	if dd.async() {
+		return handleQueueErrors(delivery, nil)
+	}
+
+	return handlePayloadErrors(dd.process(delivery, dl.Payload))
+}
+
+func handleDiscardDeadLetter(dd *deliveryDispatcher, l *hookwormLogger, params martini.Params) (int, string) {
+	if dd.deadLetters == nil {
+		return http.StatusNotFound, noDeadLettersJSON
+	}
+
+	removed, err := dd.deadLetters.remove(params["id"])
+	if err != nil {
+		l.Printf("ERROR: failed to remove dead letter %s: %v\n", params["id"], err)
+		return http.StatusInternalServerError, boomExplosionsJSON
+	}
+
+	if !removed {
+		return http.StatusNotFound, noSuchDeadLetterJSON
+	}
+
+	l.Printf("Discarded dead letter %s\n", params["id"])
+	return http.StatusNoContent, ""
+}
+
+// getDeadLetter looks up the dead letter, returning the status and body of
+// an error response if it cannot be found
+func getDeadLetter(dd *deliveryDispatcher, l *hookwormLogger, id string) (*deadLetter, int, string) {
+	if dd.deadLetters == nil {
+		return nil, http.StatusNotFound, noDeadLettersJSON
+	}
+
+	dl, err := dd.deadLetters.get(id)
+	if err != nil {
+		l.Printf("ERROR: failed to read dead letter %s: %v\n", id, err)
+		return nil, http.StatusInternalServerError, boomExplosionsJSON
+	}
+
+	if dl == nil {
+		return nil, http.StatusNotFound, noSuchDeadLetterJSON
+	}
+
+	return dl, http.StatusOK, ""
+}
+
+func renderDeadLetterJSON(v interface{}, w http.ResponseWriter) (int, string) {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, boomExplosionsJSON
+	}
+
+	w.Header().Set("Content-Type", ctypeJSON)
+	return http.StatusOK, string(content)
+}
@@ -0,0 +1,61 @@
+package hookworm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// interpreterFlagMap maps handler file extensions to the interpreters used
+// to run them, adding to or overriding the defaults in interpreterMap, and
+// is usable as a repeatable flag value
+type interpreterFlagMap map[string]string
+
+func (im interpreterFlagMap) String() string {
+	var exts []string
+	for ext := range im {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+
+	s := ""
+	for _, ext := range exts {
+		s += fmt.Sprintf("%s=%s;", ext, im[ext])
+	}
+	return s
+}
+
+// Set accepts one or more `ext=command` pairs separated by `;`.  The leading
+// `.` of the extension is optional.
+func (im interpreterFlagMap) Set(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid interpreter %q: expected ext=command", pair)
+		}
+
+		ext := strings.TrimSpace(parts[0])
+		command := strings.TrimSpace(parts[1])
+
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+
+		if ext == "." || strings.ContainsAny(ext, " \t/") || strings.Count(ext, ".") > 1 {
+			return fmt.Errorf("invalid interpreter extension %q", parts[0])
+		}
+
+		if command == "" || strings.ContainsAny(command, " \t") {
+			return fmt.Errorf("invalid interpreter command %q for %s", command, ext)
+		}
+
+		im[ext] = command
+	}
+
+	return nil
+}
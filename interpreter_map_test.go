@@ -0,0 +1,27 @@
+package hookworm
+
+import (
+	"testing"
+)
+
+func TestInterpreterFlagMapSet(t *testing.T) {
+	im := interpreterFlagMap{}
+	if err := im.Set("lua=luajit; .php=php7"); err != nil {
+		t.Fatal(err)
+	}
+
+	if im[".lua"] != "luajit" || im[".php"] != "php7" {
+		t.Errorf("unexpected interpreters %+v", im)
+	}
+	if im.String() != ".lua=luajit;.php=php7;" {
+		t.Errorf("unexpected string %q", im.String())
+	}
+}
+
+func TestInterpreterFlagMapSetRejectsBadValues(t *testing.T) {
+	for _, value := range []string{"lua", "=lua", ".=lua", "tar.gz=tar", "lua=", "php=php -n", "a/b=sh"} {
+		if err := (interpreterFlagMap{}).Set(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package hookworm
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	journalAccepted  = "accepted"
+	journalCompleted = "completed"
+	journalFailed    = "failed"
+
+	journalFileName = "journal.jsonl"
+
+	// journalCompactAfter is the number of finished deliveries after which
+	// the journal is compacted while running
+	journalCompactAfter = 1000
+)
+
+var (
+	// unjournaledHeaders are never written to disk or exposed via the API
+	unjournaledHeaders = []string{
+		"Authorization",
+		"Cookie",
+		"X-Gitlab-Token",
+	}
+)
+
+// journalEntry is a single line of the append-only delivery journal.  An
+// accepted entry carries everything needed to replay the delivery, and is
+// followed by a completed or failed entry with the same ID once the
+// delivery has been processed.
+type journalEntry struct {
+	ID       string      `json:"id"`
+	Op       string      `json:"op"`
+	Time     time.Time   `json:"time"`
+	SourceID string      `json:"source_id,omitempty"`
+	Source   string      `json:"source,omitempty"`
+	Event    string      `json:"event,omitempty"`
+	Headers  http.Header `json:"headers,omitempty"`
+	Payload  string      `json:"payload,omitempty"`
+	Error    string      `json:"error,omitempty"`
+}
+
+// deliveryJournal is a write-ahead log of deliveries kept in the data dir so
+// that deliveries which were accepted but never finished may be resumed
+// after a restart.  The unfinished entries are also kept in memory so that
+// the journal may be compacted every so often while running, rather than
+// growing with every delivery until the next restart.
+type deliveryJournal struct {
+	sync.Mutex
+	path         string
+	file         *os.File
+	pending      []*journalEntry
+	sinceCompact int
+	compactAfter int
+}
+
+// openDeliveryJournal opens (creating if needed) the journal in the given
+// directory, returning the accepted entries that were never finished.  The
+// journal is compacted so that only those entries remain.
+func openDeliveryJournal(dataDir string) (*deliveryJournal, []*journalEntry, error) {
+	if err := os.MkdirAll(dataDir, 0750); err != nil {
+		return nil, nil, err
+	}
+
+	journalPath := filepath.Join(dataDir, journalFileName)
+
+	pending, err := readPendingJournalEntries(journalPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := compactJournal(journalPath, pending); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dj := &deliveryJournal{
+		path:         journalPath,
+		file:         file,
+		pending:      append([]*journalEntry(nil), pending...),
+		compactAfter: journalCompactAfter,
+	}
+	return dj, pending, nil
+}
+
+func readPendingJournalEntries(journalPath string) ([]*journalEntry, error) {
+	var (
+		order   []string
+		entries = map[string]*journalEntry{}
+	)
+
+	file, err := os.Open(journalPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineno := 1; ; lineno++ {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := &journalEntry{}
+			if jsonErr := json.Unmarshal(line, entry); jsonErr != nil {
+				logger.Printf("Skipping unreadable journal line %v:%d: %v\n", journalPath, lineno, jsonErr)
+			} else if entry.Op == journalAccepted {
+				if _, ok := entries[entry.ID]; !ok {
+					order = append(order, entry.ID)
+				}
+				entries[entry.ID] = entry
+			} else {
+				delete(entries, entry.ID)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	// an ID accepted again after it finished appears in the order twice,
+	// but is only pending once
+	var pending []*journalEntry
+	for _, id := range order {
+		if entry, ok := entries[id]; ok {
+			pending = append(pending, entry)
+			delete(entries, id)
+		}
+	}
+
+	return pending, nil
+}
+
+func compactJournal(journalPath string, pending []*journalEntry) error {
+	tmpPath := journalPath + ".tmp"
+
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(tmp)
+	for _, entry := range pending {
+		if err := enc.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, journalPath)
+}
+
+func (dj *deliveryJournal) write(entry *journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	dj.Lock()
+	defer dj.Unlock()
+
+	if _, err := dj.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if err := dj.file.Sync(); err != nil {
+		return err
+	}
+
+	for i, pending := range dj.pending {
+		if pending.ID == entry.ID {
+			dj.pending = append(dj.pending[:i], dj.pending[i+1:]...)
+			break
+		}
+	}
+
+	if entry.Op == journalAccepted {
+		dj.pending = append(dj.pending, entry)
+		return nil
+	}
+
+	dj.sinceCompact++
+	if dj.compactAfter > 0 && dj.sinceCompact >= dj.compactAfter {
+		if err := dj.compact(); err != nil {
+			logger.Printf("ERROR: failed to compact journal %v: %v\n", dj.path, err)
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the journal with only the unfinished entries and
+// reopens it.  The journal must be locked.
+func (dj *deliveryJournal) compact() error {
+	if err := compactJournal(dj.path, dj.pending); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(dj.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+
+	dj.file.Close()
+	dj.file = file
+	dj.sinceCompact = 0
+
+	logger.Debugf("Compacted journal %v to %d unfinished deliveries\n", dj.path, len(dj.pending))
+	return nil
+}
+
+func (dj *deliveryJournal) accepted(d *Delivery, payload string) error {
+	return dj.write(&journalEntry{
+		ID:       d.ID,
+		Op:       journalAccepted,
+		Time:     d.AcceptedAt,
+		SourceID: d.SourceID,
+		Source:   d.Source,
+		Event:    d.Event,
+		Headers:  d.Headers,
+		Payload:  payload,
+	})
+}
+
+func (dj *deliveryJournal) finished(d *Delivery, err error) error {
+	entry := &journalEntry{
+		ID:   d.ID,
+		Op:   journalCompleted,
+		Time: time.Now().UTC(),
+	}
+
+	if err != nil {
+		entry.Op = journalFailed
+		entry.Error = err.Error()
+	}
+
+	return dj.write(entry)
+}
+
+func (dj *deliveryJournal) Close() error {
+	dj.Lock()
+	defer dj.Unlock()
+
+	return dj.file.Close()
+}
+
+// journaledHeaders returns a copy of the request headers without any that
+// carry credentials
+func journaledHeaders(header http.Header) http.Header {
+	ret := http.Header{}
+	for k, v := range header {
+		ret[k] = v
+	}
+
+	for _, k := range unjournaledHeaders {
+		ret.Del(k)
+	}
+
+	return ret
+}
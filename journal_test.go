@@ -0,0 +1,275 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newJournalTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "hookworm-test-journal-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestJournalReturnsUnfinishedDeliveries(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	journal, pending, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("unexpected pending deliveries in new journal: %+v", pending)
+	}
+
+	done := &Delivery{ID: "done", Source: "github", AcceptedAt: time.Now().UTC()}
+	failed := &Delivery{ID: "failed", Source: "github", AcceptedAt: time.Now().UTC()}
+	lost := &Delivery{ID: "lost", Source: "travis", Event: "", AcceptedAt: time.Now().UTC(),
+		Headers: http.Header{"X-Foo": []string{"bar"}}}
+
+	for _, d := range []*Delivery{done, failed, lost} {
+		if err := journal.accepted(d, `{"id":"`+d.ID+`"}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journal.finished(done, nil)
+	journal.finished(failed, fmt.Errorf("nope"))
+	journal.Close()
+
+	journal, pending, err = openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if len(pending) != 1 {
+		t.Fatalf("expected one pending delivery, got %+v", pending)
+	}
+
+	entry := pending[0]
+	if entry.ID != "lost" || entry.Source != "travis" || entry.Payload != `{"id":"lost"}` ||
+		entry.Headers.Get("X-Foo") != "bar" {
+		t.Errorf("unexpected pending entry %+v", entry)
+	}
+
+	compacted, err := ioutil.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(compacted), "\n") != 1 {
+		t.Errorf("expected compacted journal, got %q", string(compacted))
+	}
+}
+
+func TestJournalCompactsWhileRunning(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	journal, _, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	journal.compactAfter = 2
+
+	var deliveries []*Delivery
+	for _, id := range []string{"first", "second", "third"} {
+		d := &Delivery{ID: id, Source: "github", AcceptedAt: time.Now().UTC()}
+		if err := journal.accepted(d, `{"id":"`+id+`"}`); err != nil {
+			t.Fatal(err)
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	journal.finished(deliveries[0], nil)
+	journal.finished(deliveries[2], fmt.Errorf("nope"))
+
+	compacted, err := ioutil.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(compacted), "\n") != 1 || !strings.Contains(string(compacted), `"id":"second"`) {
+		t.Fatalf("expected journal compacted to the unfinished delivery, got %q", compacted)
+	}
+
+	fourth := &Delivery{ID: "fourth", Source: "github", AcceptedAt: time.Now().UTC()}
+	if err := journal.accepted(fourth, `{"id":"fourth"}`); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := readPendingJournalEntries(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0].ID != "second" || pending[1].ID != "fourth" {
+		t.Errorf("expected writes to continue after compaction, got %+v", pending)
+	}
+}
+
+func TestJournalResumesReacceptedDeliveryOnce(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	journal, _, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Delivery{ID: "again", Source: "github", AcceptedAt: time.Now().UTC()}
+	journal.accepted(d, `{"attempt":1}`)
+	journal.finished(d, nil)
+	journal.accepted(d, `{"attempt":2}`)
+	journal.Close()
+
+	journal, pending, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if len(pending) != 1 || pending[0].Payload != `{"attempt":2}` {
+		t.Errorf("expected the delivery accepted again to be pending once, got %+v", pending)
+	}
+}
+
+func TestJournalSkipsUnreadableLines(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	entry, _ := json.Marshal(&journalEntry{ID: "ok", Op: journalAccepted, Source: "github", Payload: `{}`})
+	content := string(entry) + "\n" + `{"id":"trunc`
+	ioutil.WriteFile(filepath.Join(dir, journalFileName), []byte(content), 0640)
+
+	journal, pending, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	if len(pending) != 1 || pending[0].ID != "ok" {
+		t.Errorf("unexpected pending entries %+v", pending)
+	}
+}
+
+func TestJournaledHeadersOmitsCredentials(t *testing.T) {
+	headers := journaledHeaders(http.Header{
+		"Authorization":  []string{"Basic Zm9vOmJhcg=="},
+		"X-Gitlab-Token": []string{"t0k3n"},
+		"X-Github-Event": []string{"push"},
+	})
+
+	if headers.Get("Authorization") != "" || headers.Get("X-Gitlab-Token") != "" {
+		t.Errorf("credentials leaked into %+v", headers)
+	}
+	if headers.Get("X-Github-Event") != "push" {
+		t.Fail()
+	}
+}
+
+func TestServerResumesUnfinishedDeliveries(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	journal, _, err := openDeliveryJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.accepted(&Delivery{ID: "resume-me", Source: "github", Event: "push", AcceptedAt: time.Now().UTC()},
+		getPayload("github", "valid"))
+	journal.Close()
+
+	cfg := *serverTestConfig
+	cfg.DataDir = dir
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 250; i++ {
+		req, _ := http.NewRequest("GET", "/deliveries/resume-me", nil)
+		hr := httptest.NewRecorder()
+		m.ServeHTTP(hr, req)
+
+		d := map[string]interface{}{}
+		json.Unmarshal(hr.Body.Bytes(), &d)
+
+		if d["state"] == deliveryCompleted {
+			break
+		}
+		if d["state"] == deliveryFailed {
+			t.Fatalf("resumed delivery failed: %+v", d)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// the journal is written just after the state is updated
+	for i := 0; i < 50; i++ {
+		pending, err := readPendingJournalEntries(filepath.Join(dir, journalFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatalf("resumed delivery was never marked finished in the journal")
+}
+
+func TestServerJournalsAcceptedDeliveries(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := *serverTestConfig
+	cfg.DataDir = dir
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("POST", "/github-test", getPayloadJSONReader("github", "valid"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Delivery", "journaled-1")
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+
+	if hr.Code != 204 {
+		t.Fatalf("unexpected status %v: %s", hr.Code, hr.Body.String())
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected accepted and completed entries, got %q", string(content))
+	}
+
+	for i, op := range []string{journalAccepted, journalCompleted} {
+		entry := &journalEntry{}
+		if err := json.Unmarshal([]byte(lines[i]), entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.ID != hr.Header().Get("X-Hookworm-Delivery") || entry.Op != op ||
+			(op == journalAccepted && entry.SourceID != "journaled-1") {
+			t.Errorf("unexpected journal entry %+v", entry)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	limitAddressSpace = "as"
+	limitCPU          = "cpu"
+	limitProcesses    = "nproc"
+	limitOpenFiles    = "nofile"
+	limitCore         = "core"
+
+	// limitUnlimited lifts a limit, e.g. to override a global limit for a
+	// single handler
+	limitUnlimited = ^uint64(0)
+
+	// LimitShimCommand is the subcommand under which an executable that
+	// has called EnableLimitShim must run LimitShimMain
+	LimitShimCommand = "limit-shim"
+
+	// limitShimFailed is the exit status of the shim when the limits cannot
+	// be applied or the handler cannot be executed
+	limitShimFailed = 126
+)
+
+var (
+	// limitShimEnabled is set once the running executable has declared
+	// that it runs LimitShimMain as LimitShimCommand
+	limitShimEnabled = false
+
+	// limitUnits are the units each limit is given in, for messages
+	limitUnits = map[string]string{
+		limitAddressSpace: "bytes",
+		limitCPU:          "seconds",
+		limitProcesses:    "processes",
+		limitOpenFiles:    "files",
+		limitCore:         "bytes",
+	}
+)
+
+// ResourceLimits are the rlimits applied to handler processes, keyed by
+// `as` (address space in bytes), `cpu` (CPU seconds), `nproc` (processes
+// owned by the user hookworm runs as), `nofile` (open files) and `core`
+// (core file size in bytes).  Limits that are not given are inherited from
+// hookworm itself.  They are usable as a repeatable flag value.
+type ResourceLimits map[string]uint64
+
+// EnableLimitShim declares that the running executable runs LimitShimMain
+// when given LimitShimCommand as its first argument, as `hookworm-server`
+// does, so that handlers with resource limits may be started through it.
+// Programs embedding hookworm that do not opt in fail such handlers rather
+// than run them without their limits.
+func EnableLimitShim() {
+	limitShimEnabled = true
+}
+
+// LimitShimMain is the entry point for the `limit-shim` subcommand, which
+// applies the limits (as formatted by ResourceLimits.String) to its own
+// process and then replaces itself with the handler, so that the limits
+// are in force before the handler runs at all.  It only returns, with
+// limitShimFailed, if it cannot do either.
+func LimitShimMain(args []string) int {
+	if len(args) < 3 {
+		fmt.Fprintf(os.Stderr, "usage: %s <limits> <path> <argv>...\n", LimitShimCommand)
+		return limitShimFailed
+	}
+
+	limits := ResourceLimits{}
+	err := limits.Set(args[0])
+	if err == nil {
+		err = applyResourceLimits(0, limits)
+	}
+	if err == nil {
+		err = syscall.Exec(args[1], args[2:], os.Environ())
+	}
+
+	fmt.Fprintf(os.Stderr, "hookworm: failed to run %v with limits %s: %v\n", args[1], args[0], err)
+	return limitShimFailed
+}
+
+// merge returns a copy of the limits with any limits given in the other
+// taking precedence
+func (rl ResourceLimits) merge(other ResourceLimits) ResourceLimits {
+	merged := ResourceLimits{}
+	for name, value := range rl {
+		merged[name] = value
+	}
+	for name, value := range other {
+		merged[name] = value
+	}
+	return merged
+}
+
+func (rl ResourceLimits) String() string {
+	var names []string
+	for name := range rl {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := ""
+	for _, name := range names {
+		s += fmt.Sprintf("%s=%s;", name, formatLimit(rl[name]))
+	}
+	return s
+}
+
+// Set accepts one or more `name=value` pairs separated by `;`.  Sizes may
+// have a `K`, `M` or `G` suffix, and any limit may be `unlimited`.
+func (rl ResourceLimits) Set(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid limit %q: expected name=value", pair)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		limit, err := parseLimit(name, strings.TrimSpace(parts[1]))
+		if err != nil {
+			return err
+		}
+
+		rl[name] = limit
+	}
+
+	return nil
+}
+
+// UnmarshalJSON accepts limits given either as numbers or as strings in the
+// same form as the flag value, e.g. `{"as": "512M", "cpu": 60}`
+func (rl *ResourceLimits) UnmarshalJSON(b []byte) error {
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	limits := ResourceLimits{}
+	for name, value := range raw {
+		s := string(value)
+
+		var unquoted string
+		if err := json.Unmarshal(value, &unquoted); err == nil {
+			s = unquoted
+		}
+
+		limit, err := parseLimit(name, s)
+		if err != nil {
+			return err
+		}
+
+		limits[name] = limit
+	}
+
+	*rl = limits
+	return nil
+}
+
+func parseLimit(name, value string) (uint64, error) {
+	if _, ok := limitUnits[name]; !ok {
+		return 0, fmt.Errorf("unknown limit %q (expected as, cpu, nproc, nofile or core)", name)
+	}
+
+	if value == "unlimited" {
+		return limitUnlimited, nil
+	}
+
+	multiplier := uint64(1)
+	if name == limitAddressSpace || name == limitCore {
+		switch {
+		case strings.HasSuffix(value, "K"):
+			multiplier = 1 << 10
+		case strings.HasSuffix(value, "M"):
+			multiplier = 1 << 20
+		case strings.HasSuffix(value, "G"):
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s limit %q", name, value)
+	}
+
+	return limit * multiplier, nil
+}
+
+func formatLimit(limit uint64) string {
+	if limit == limitUnlimited {
+		return "unlimited"
+	}
+	return strconv.FormatUint(limit, 10)
+}
+
+// limitExceeded is a handler that was killed for hitting one of its
+// resource limits
+type limitExceeded struct {
+	limit string
+	value uint64
+	err   error
+}
+
+func (e *limitExceeded) Error() string {
+	return fmt.Sprintf("exceeded %s limit of %s %s: %v",
+		e.limit, formatLimit(e.value), limitUnits[e.limit], e.err)
+}
+
+// limitError returns the limit the command was killed for hitting, if any,
+// given the error it exited with.  Running out of CPU time is recognised by
+// SIGXCPU, or SIGKILL once the CPU time used reaches the limit, and running
+// out of address space by the handler crashing with a signal that a failed
+// allocation may lead to while an `as` limit is in force.  Any other signal
+// is left to be reported as such.
+func limitError(cmd *exec.Cmd, limits ResourceLimits, err error) error {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok || len(limits) == 0 {
+		return err
+	}
+
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return err
+	}
+
+	if cpu, ok := limits[limitCPU]; ok && cpu != limitUnlimited {
+		switch status.Signal() {
+		case syscall.SIGXCPU:
+			return &limitExceeded{limit: limitCPU, value: cpu, err: err}
+		case syscall.SIGKILL:
+			if cpuTime(cmd) >= time.Duration(cpu)*time.Second {
+				return &limitExceeded{limit: limitCPU, value: cpu, err: err}
+			}
+		}
+	}
+
+	if as, ok := limits[limitAddressSpace]; ok && as != limitUnlimited {
+		switch status.Signal() {
+		case syscall.SIGSEGV, syscall.SIGABRT, syscall.SIGBUS:
+			return &limitExceeded{limit: limitAddressSpace, value: as, err: err}
+		}
+	}
+
+	return err
+}
+
+func cpuTime(cmd *exec.Cmd) time.Duration {
+	if cmd.ProcessState == nil {
+		return 0
+	}
+	return cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+}
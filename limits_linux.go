@@ -0,0 +1,63 @@
+package hookworm
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	resourceLimitsSupported = true
+
+	// rlimitNproc is RLIMIT_NPROC, which the syscall package lacks
+	rlimitNproc = 6
+)
+
+var (
+	rlimitResources = map[string]int{
+		limitAddressSpace: syscall.RLIMIT_AS,
+		limitCPU:          syscall.RLIMIT_CPU,
+		limitProcesses:    rlimitNproc,
+		limitOpenFiles:    syscall.RLIMIT_NOFILE,
+		limitCore:         syscall.RLIMIT_CORE,
+	}
+)
+
+type rlimit64 struct {
+	cur uint64
+	max uint64
+}
+
+// limitCmd arranges for the command to be started through our own
+// executable acting as the limit shim (see LimitShimMain), if it has opted
+// in to doing so
+func limitCmd(cmd *exec.Cmd, limits ResourceLimits) error {
+	if !limitShimEnabled {
+		return fmt.Errorf("resource limits require an executable that runs %s (see EnableLimitShim)", LimitShimCommand)
+	}
+
+	cmd.Args = append([]string{cmd.Args[0], LimitShimCommand, limits.String(), cmd.Path}, cmd.Args...)
+	cmd.Path = "/proc/self/exe"
+	return nil
+}
+
+// applyResourceLimits sets the limits on the process (or the calling
+// process, given a pid of 0) via prlimit(2).  The hard CPU limit is a
+// second past the soft one, so that the process is first sent SIGXCPU.
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	for name, value := range limits {
+		rlim := &rlimit64{cur: value, max: value}
+		if name == limitCPU && value != limitUnlimited {
+			rlim.max = value + 1
+		}
+
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid),
+			uintptr(rlimitResources[name]), uintptr(unsafe.Pointer(rlim)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("failed to set %s limit: %v", name, errno)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const limitsHandlerBody = `#!/usr/bin/env python
+import os
+import resource
+import signal
+import sys
+
+if sys.argv[1] == 'spin':
+    while True:
+        pass
+if sys.argv[1] == 'kill':
+    os.kill(os.getpid(), signal.SIGKILL)
+
+soft, hard = resource.getrlimit(resource.RLIMIT_NOFILE)
+sys.stdout.write('%d %d' % (soft, hard))
+`
+
+func newLimitsTestCommand(limits ResourceLimits, t *testing.T) (string, *shellCommand) {
+	dir := newJournalTestDir(t)
+	filePath := filepath.Join(dir, "limits.py")
+	ioutil.WriteFile(filePath, []byte(limitsHandlerBody), 0755)
+
+	sc := newShellCommand("python", filePath, 10, 0)
+	sc.limits = limits
+	return dir, &sc
+}
+
+func TestResourceLimitsApplied(t *testing.T) {
+	dir, sc := newLimitsTestCommand(ResourceLimits{limitOpenFiles: 64}, t)
+	defer os.RemoveAll(dir)
+
+	output, err := sc.runCmd("", "", nil, ioutil.Discard, "nofile")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(string(output.out)) != "64 64" {
+		t.Errorf("expected nofile limit to be applied, got %q", output.out)
+	}
+}
+
+func TestResourceLimitExceeded(t *testing.T) {
+	dir, sc := newLimitsTestCommand(ResourceLimits{limitCPU: 1}, t)
+	defer os.RemoveAll(dir)
+
+	_, err := sc.runCmd("", "", nil, ioutil.Discard, "spin")
+
+	le, ok := err.(*limitExceeded)
+	if !ok {
+		t.Fatalf("expected exceeded limit error, got %T %v", err, err)
+	}
+
+	if le.limit != limitCPU || !strings.Contains(le.Error(), "cpu limit of 1 seconds") {
+		t.Errorf("unexpected error %v", le)
+	}
+
+	if he := newHandlerError(sc.filePath, nil, err); he.Limit != limitCPU {
+		t.Errorf("expected handler error to name the limit: %+v", he)
+	}
+}
+
+func TestResourceLimitsNotAppliedFailHandler(t *testing.T) {
+	dir, sc := newLimitsTestCommand(ResourceLimits{limitOpenFiles: 1 << 40}, t)
+	defer os.RemoveAll(dir)
+
+	output, err := sc.runCmd("", "", nil, ioutil.Discard, "nofile")
+	if err == nil || len(output.out) > 0 {
+		t.Fatalf("expected the handler not to run without its limits, got %q %v", output.out, err)
+	}
+
+	if !strings.Contains(string(output.stderr), "failed to set nofile limit") {
+		t.Errorf("expected the limit to be named, got %q", output.stderr)
+	}
+}
+
+func TestResourceLimitNotBlamedForOtherSignals(t *testing.T) {
+	dir, sc := newLimitsTestCommand(ResourceLimits{limitAddressSpace: 4 << 30, limitCPU: 60}, t)
+	defer os.RemoveAll(dir)
+
+	_, err := sc.runCmd("", "", nil, ioutil.Discard, "kill")
+	if _, ok := err.(*limitExceeded); ok || err == nil || !strings.Contains(err.Error(), "signal: killed") {
+		t.Errorf("expected a plain signal exit, got %T %v", err, err)
+	}
+}
+
+func TestResourceLimitsRequireLimitShim(t *testing.T) {
+	dir, sc := newLimitsTestCommand(ResourceLimits{limitOpenFiles: 64}, t)
+	defer os.RemoveAll(dir)
+
+	limitShimEnabled = false
+	defer EnableLimitShim()
+
+	output, err := sc.runCmd("", "", nil, ioutil.Discard, "nofile")
+	if err == nil || len(output.out) > 0 || !strings.Contains(err.Error(), "EnableLimitShim") {
+		t.Errorf("expected the handler not to run without the limit shim, got %q %v", output.out, err)
+	}
+}
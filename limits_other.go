@@ -0,0 +1,23 @@
+// +build !linux
+
+package hookworm
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+const (
+	resourceLimitsSupported = false
+)
+
+func limitCmd(cmd *exec.Cmd, limits ResourceLimits) error {
+	return applyResourceLimits(0, limits)
+}
+
+func applyResourceLimits(pid int, limits ResourceLimits) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	return fmt.Errorf("resource limits are only supported on linux")
+}
@@ -0,0 +1,70 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestResourceLimitsSet(t *testing.T) {
+	rl := ResourceLimits{}
+	if err := rl.Set("as=512M; cpu=60;nofile=256;core=0;nproc=unlimited"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rl[limitAddressSpace] != 512<<20 || rl[limitCPU] != 60 || rl[limitOpenFiles] != 256 ||
+		rl[limitCore] != 0 || rl[limitProcesses] != limitUnlimited {
+		t.Errorf("unexpected limits %+v", rl)
+	}
+
+	if rl.String() != "as=536870912;core=0;cpu=60;nofile=256;nproc=unlimited;" {
+		t.Errorf("unexpected string %q", rl.String())
+	}
+}
+
+func TestResourceLimitsSetRejectsBadValues(t *testing.T) {
+	for _, value := range []string{"as", "rss=1", "cpu=1M", "as=-1", "nofile=lots", "=1"} {
+		if err := (ResourceLimits{}).Set(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestResourceLimitsUnmarshalJSON(t *testing.T) {
+	rl := ResourceLimits{}
+	if err := json.Unmarshal([]byte(`{"as": "1G", "cpu": 30, "core": "unlimited"}`), &rl); err != nil {
+		t.Fatal(err)
+	}
+
+	if rl[limitAddressSpace] != 1<<30 || rl[limitCPU] != 30 || rl[limitCore] != limitUnlimited {
+		t.Errorf("unexpected limits %+v", rl)
+	}
+
+	if err := json.Unmarshal([]byte(`{"cpu": 1.5}`), &rl); err == nil {
+		t.Errorf("expected fractional limit to be rejected")
+	}
+}
+
+func TestResourceLimitsMerge(t *testing.T) {
+	global := ResourceLimits{limitCPU: 60, limitOpenFiles: 256}
+	merged := global.merge(ResourceLimits{limitCPU: limitUnlimited})
+
+	if merged[limitCPU] != limitUnlimited || merged[limitOpenFiles] != 256 || global[limitCPU] != 60 {
+		t.Errorf("unexpected merge %+v of %+v", merged, global)
+	}
+
+	if merged := ResourceLimits(nil).merge(nil); merged == nil || len(merged) != 0 {
+		t.Errorf("expected empty limits, got %+v", merged)
+	}
+}
+
+func TestManifestLimitsValidation(t *testing.T) {
+	mh := &manifestHandler{Handler: "whatever", Limits: ResourceLimits{limitCPU: 1}}
+	if err := mh.validate(); err == nil {
+		t.Errorf("expected limits on a native handler to be rejected")
+	}
+
+	mh = &manifestHandler{Forward: &forwarder{URL: "http://localhost/"}, Limits: ResourceLimits{limitCPU: 1}}
+	if err := mh.validate(); err == nil {
+		t.Errorf("expected limits on a forward entry to be rejected")
+	}
+}
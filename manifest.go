@@ -0,0 +1,206 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	wormManifestName = "worm.json"
+
+	failureAbort    = "abort"
+	failureContinue = "continue"
+)
+
+var (
+	// yamlManifestNames are YAML worm manifests, which are not supported,
+	// but are never mistaken for handlers either
+	yamlManifestNames = []string{"worm.yml", "worm.yaml"}
+)
+
+// wormManifest is the optional `worm.json` file in the worm dir that lists
+// handlers explicitly, in pipeline order
+type wormManifest struct {
+	Handlers []*manifestHandler        `json:"handlers"`
+	Groups   map[string]*manifestGroup `json:"groups"`
+}
+
+// manifestGroup describes how the outputs of a group of handlers that run
+// concurrently are merged
+type manifestGroup struct {
+	Merge string `json:"merge"`
+	Owner string `json:"owner"`
+}
+
+// manifestHandler is a single handler entry in the worm manifest.  One of
+// Command, Handler, which names a registered native handler, or Forward is
+// required.
+type manifestHandler struct {
+	Command     string            `json:"command"`
+	Handler     string            `json:"handler"`
+	Forward     *forwarder        `json:"forward"`
+	Group       string            `json:"group"`
+	Interpreter string            `json:"interpreter"`
+	Args        []string          `json:"args"`
+	Sources     []string          `json:"sources"`
+	Events      []string          `json:"events"`
+	Filter      *payloadFilter    `json:"filter"`
+	Timeout     int               `json:"timeout"`
+	Env         map[string]string `json:"env"`
+	Enabled     *bool             `json:"enabled"`
+	OnFailure   string            `json:"on_failure"`
+	Retry       *RetryPolicy      `json:"retry"`
+	Persistent  *bool             `json:"persistent"`
+	Limits      ResourceLimits    `json:"limits"`
+	Output      *OutputPolicy     `json:"output"`
+	Sandbox     *SandboxProfile   `json:"sandbox"`
+}
+
+// loadWormManifest reads the manifest from the worm dir, returning nil if
+// there is none
+func loadWormManifest(wormDir string) (*wormManifest, error) {
+	for _, name := range yamlManifestNames {
+		yamlPath := filepath.Join(wormDir, name)
+		if _, err := os.Stat(yamlPath); err == nil {
+			logger.Printf("WARNING: ignoring %v, as only JSON worm manifests (%v) are supported\n",
+				yamlPath, wormManifestName)
+		}
+	}
+
+	manifestPath := filepath.Join(wormDir, wormManifestName)
+
+	content, err := ioutil.ReadFile(manifestPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &wormManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("invalid worm manifest %v: %v", manifestPath, err)
+	}
+
+	seenGroups := map[string]bool{}
+	for i, mh := range manifest.Handlers {
+		if err := mh.validate(); err != nil {
+			return nil, fmt.Errorf("invalid worm manifest %v: handler %d: %v", manifestPath, i, err)
+		}
+
+		if mh.Group == "" || (i > 0 && manifest.Handlers[i-1].Group == mh.Group) {
+			continue
+		}
+
+		if seenGroups[mh.Group] {
+			return nil, fmt.Errorf("invalid worm manifest %v: handler %d: handlers in group %q must be listed together",
+				manifestPath, i, mh.Group)
+		}
+		seenGroups[mh.Group] = true
+	}
+
+	for name, mg := range manifest.Groups {
+		switch mg.Merge {
+		case "", mergeFirst, mergeJSON:
+		case mergeOwner:
+			if mg.Owner == "" {
+				return nil, fmt.Errorf("invalid worm manifest %v: group %q: missing owner", manifestPath, name)
+			}
+		default:
+			return nil, fmt.Errorf("invalid worm manifest %v: group %q: unknown merge %q", manifestPath, name, mg.Merge)
+		}
+	}
+
+	return manifest, nil
+}
+
+func (mh *manifestHandler) validate() error {
+	if mh.Handler != "" {
+		if mh.Command != "" || mh.Forward != nil || mh.Group != "" || mh.Interpreter != "" || len(mh.Args) > 0 ||
+			len(mh.Sources) > 0 || len(mh.Events) > 0 || mh.Filter != nil || mh.Timeout != 0 ||
+			len(mh.Env) > 0 || mh.OnFailure != "" || mh.Retry != nil || mh.Persistent != nil || len(mh.Limits) > 0 || mh.Output != nil || mh.Sandbox != nil {
+			return fmt.Errorf("native handler %q may only be combined with enabled", mh.Handler)
+		}
+
+		if _, ok := lookupHandlerFactory(mh.Handler); !ok {
+			return fmt.Errorf("no handler registered as %q", mh.Handler)
+		}
+
+		return nil
+	}
+
+	if mh.Forward != nil {
+		if mh.Command != "" || mh.Interpreter != "" || len(mh.Args) > 0 || len(mh.Env) > 0 || mh.Persistent != nil ||
+			len(mh.Limits) > 0 || mh.Sandbox != nil {
+			return fmt.Errorf("forward may not be combined with command, interpreter, args, env, persistent, limits or sandbox")
+		}
+
+		if err := mh.Forward.validate(); err != nil {
+			return err
+		}
+	} else if mh.Command == "" {
+		return fmt.Errorf("missing command, handler or forward")
+	}
+
+	switch mh.OnFailure {
+	case "", failureAbort, failureContinue:
+	default:
+		return fmt.Errorf("unknown on_failure %q", mh.OnFailure)
+	}
+
+	if mh.Timeout < 0 {
+		return fmt.Errorf("negative timeout %d", mh.Timeout)
+	}
+
+	if mh.Output != nil {
+		if err := mh.Output.validate(); err != nil {
+			return err
+		}
+	}
+
+	if mh.Sandbox != nil {
+		if err := mh.Sandbox.resolve(); err != nil {
+			return err
+		}
+	}
+
+	if mh.Filter != nil {
+		return mh.Filter.compile()
+	}
+
+	return nil
+}
+
+func (mh *manifestHandler) enabled() bool {
+	return mh.Enabled == nil || *mh.Enabled
+}
+
+// path returns the absolute path of the handler command, which is relative
+// to the worm dir unless already absolute, or the URL payloads are
+// forwarded to
+func (mh *manifestHandler) path(wormDir string) string {
+	if mh.Forward != nil {
+		return mh.Forward.URL
+	}
+
+	if filepath.IsAbs(mh.Command) {
+		return filepath.Clean(mh.Command)
+	}
+
+	return filepath.Join(wormDir, mh.Command)
+}
+
+// environ returns the handler's extra environment as sorted KEY=value pairs
+func (mh *manifestHandler) environ() []string {
+	var env []string
+	for k, v := range mh.Env {
+		env = append(env, k+"="+v)
+	}
+
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,224 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const manifestArgvHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+
+if 'configure' in sys.argv:
+    json.dump({'events': ['push']}, sys.stdout)
+    sys.exit(0)
+
+payload = json.load(sys.stdin)
+payload.setdefault('seen', []).append({
+    'argv': sys.argv[1:],
+    'greeting': os.environ.get('GREETING'),
+})
+json.dump(payload, sys.stdout)
+sys.exit(0)
+`
+
+const manifestFailingHandlerBody = `#!/usr/bin/env python
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+sys.exit(1)
+`
+
+func setupManifestWormDir(manifest string, t *testing.T) (string, *HandlerConfig) {
+	dir := newJournalTestDir(t)
+
+	for name, body := range map[string]string{
+		"argv.py":     manifestArgvHandlerBody,
+		"10-argv.py":  manifestArgvHandlerBody,
+		"20-fails.py": manifestFailingHandlerBody,
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0755)
+	}
+
+	if manifest != "" {
+		ioutil.WriteFile(filepath.Join(dir, wormManifestName), []byte(manifest), 0644)
+	}
+
+	return dir, &HandlerConfig{WormDir: dir, WormTimeout: 5}
+}
+
+func pipelineHandlerPaths(pipeline Handler) []string {
+	var paths []string
+	for nh := pipeline.NextHandler(); nh != nil; nh = nh.NextHandler() {
+		paths = append(paths, filepath.Base(nh.(*shellHandler).command.filePath))
+	}
+	return paths
+}
+
+func TestLoadWormManifestMissing(t *testing.T) {
+	dir, _ := setupManifestWormDir("", t)
+	defer os.RemoveAll(dir)
+
+	manifest, err := loadWormManifest(dir)
+	if manifest != nil || err != nil {
+		t.Errorf("unexpected manifest %+v %v", manifest, err)
+	}
+}
+
+func TestLoadWormManifestRejectsInvalidEntries(t *testing.T) {
+	for _, manifest := range []string{
+		`{"handlers": [{"command": ""}]}`,
+		`{"handlers": [{"command": "argv.py", "on_failure": "explode"}]}`,
+		`{"handlers": [{"command": "argv.py", "timeout": -1}]}`,
+		`{"handlers": {}}`,
+	} {
+		dir, cfg := setupManifestWormDir(manifest, t)
+		if _, err := NewHandlerPipeline(cfg); err == nil {
+			t.Errorf("expected %s to be rejected", manifest)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestNewHandlerPipelineWithoutManifest(t *testing.T) {
+	dir, cfg := setupManifestWormDir("", t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := strings.Join(pipelineHandlerPaths(pipeline), " "); paths != "10-argv.py 20-fails.py argv.py" {
+		t.Errorf("unexpected pipeline %v", paths)
+	}
+}
+
+func TestNewHandlerPipelineIgnoresYAMLManifest(t *testing.T) {
+	dir, cfg := setupManifestWormDir("", t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "worm.yml"), []byte("handlers:\n  - command: argv.py\n"), 0755)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := strings.Join(pipelineHandlerPaths(pipeline), " "); paths != "10-argv.py 20-fails.py argv.py" {
+		t.Errorf("expected worm.yml to be neither used nor loaded as a handler, got %v", paths)
+	}
+}
+
+func TestNewHandlerPipelineWithManifest(t *testing.T) {
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    {
+      "command": "argv.py",
+      "args": ["--loud"],
+      "sources": ["github"],
+      "env": {"GREETING": "hello"},
+      "timeout": 2
+    },
+    {"command": "20-fails.py", "enabled": false}
+  ]
+}`, t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if paths := strings.Join(pipelineHandlerPaths(pipeline), " "); paths != "argv.py 10-argv.py" {
+		t.Fatalf("unexpected pipeline %v", paths)
+	}
+
+	first := pipeline.NextHandler().(*shellHandler)
+	if first.command.timeout != 2 {
+		t.Errorf("unexpected timeout %d", first.command.timeout)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github", Event: "push"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := &struct {
+		Seen []struct {
+			Argv     []string `json:"argv"`
+			Greeting string   `json:"greeting"`
+		} `json:"seen"`
+	}{}
+	if err := json.Unmarshal([]byte(out), seen); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(seen.Seen) != 2 {
+		t.Fatalf("expected both handlers to run, got %s", out)
+	}
+	if strings.Join(seen.Seen[0].Argv, " ") != "--loud handle github push" || seen.Seen[0].Greeting != "hello" {
+		t.Errorf("unexpected manifest handler invocation %+v", seen.Seen[0])
+	}
+	if strings.Join(seen.Seen[1].Argv, " ") != "handle github push" || seen.Seen[1].Greeting != "" {
+		t.Errorf("unexpected unlisted handler invocation %+v", seen.Seen[1])
+	}
+
+	out, err = pipeline.HandlePayload(&Delivery{Source: "travis"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "argv") != 1 {
+		t.Errorf("expected manifest handler to skip travis payload, got %s", out)
+	}
+}
+
+func TestManifestHandlerEventsOverrideDeclaration(t *testing.T) {
+	dir, cfg := setupManifestWormDir("", t)
+	defer os.RemoveAll(dir)
+
+	sh, err := newManifestShellHandler(&manifestHandler{Command: "argv.py", Events: []string{"delete"}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := sh.HandlePayload(&Delivery{Source: "github", Event: "push"}, `{}`)
+	if err != nil || out != `{}` {
+		t.Errorf("expected push payload to be skipped, got %q %v", out, err)
+	}
+	if strings.Join(sh.events, ",") != "delete" {
+		t.Errorf("unexpected events %v", sh.events)
+	}
+}
+
+func TestManifestHandlerContinuesOnFailure(t *testing.T) {
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    {"command": "20-fails.py", "on_failure": "continue"},
+    {"command": "10-argv.py", "enabled": false},
+    {"command": "argv.py", "enabled": false}
+  ]
+}`, t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{"ok":true}`)
+	if err != nil || out != `{"ok":true}` {
+		t.Errorf("expected failure to be skipped, got %q %v", out, err)
+	}
+
+	pipeline.NextHandler().(*shellHandler).manifest.OnFailure = failureAbort
+	if _, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{"ok":true}`); err == nil {
+		t.Errorf("expected failure to abort the pipeline")
+	}
+}
@@ -0,0 +1,128 @@
+package hookworm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	outputFail  = "fail"
+	outputInput = "input"
+)
+
+// OutputPolicy bounds and validates the payload each handler passes along
+// to the next, so that a handler printing something stray or far too much
+// cannot corrupt the handlers after it.  A MaxSize of zero is unlimited.
+// On an invalid output, the handler either fails (OnInvalid "fail") or its
+// input is passed along in place of its output (OnInvalid "input").
+type OutputPolicy struct {
+	MaxSize   int    `json:"max_size"`
+	JSON      *bool  `json:"json"`
+	OnInvalid string `json:"on_invalid"`
+}
+
+// invalidOutput is a handler output that violates the output policy
+type invalidOutput struct {
+	reason string
+}
+
+func (e *invalidOutput) Error() string {
+	return "invalid output: " + e.reason
+}
+
+// merge returns a copy of the policy with any fields given in the other
+// policy taking precedence
+func (op *OutputPolicy) merge(other *OutputPolicy) *OutputPolicy {
+	merged := &OutputPolicy{OnInvalid: outputFail}
+	if op != nil {
+		*merged = *op
+	}
+
+	if other == nil {
+		return merged
+	}
+
+	if other.MaxSize > 0 {
+		merged.MaxSize = other.MaxSize
+	}
+	if other.JSON != nil {
+		merged.JSON = other.JSON
+	}
+	if other.OnInvalid != "" {
+		merged.OnInvalid = other.OnInvalid
+	}
+
+	return merged
+}
+
+func (op *OutputPolicy) validate() error {
+	if op.MaxSize < 0 {
+		return fmt.Errorf("negative output max_size %d", op.MaxSize)
+	}
+
+	switch op.OnInvalid {
+	case "", outputFail, outputInput:
+		return nil
+	default:
+		return fmt.Errorf("unknown output on_invalid %q", op.OnInvalid)
+	}
+}
+
+// check returns an invalidOutput error if the payload is too big or, when
+// JSON validation is on, is not a single JSON value
+func (op *OutputPolicy) check(payload string) error {
+	if op.MaxSize > 0 && len(payload) > op.MaxSize {
+		return &invalidOutput{reason: fmt.Sprintf("exceeds %d bytes", op.MaxSize)}
+	}
+
+	if op.JSON != nil && *op.JSON {
+		var v interface{}
+		if err := json.Unmarshal([]byte(payload), &v); err != nil {
+			prefix := payload
+			if len(prefix) > 64 {
+				prefix = prefix[:64] + "..."
+			}
+			return &invalidOutput{reason: fmt.Sprintf("not JSON (%v): %q", err, prefix)}
+		}
+	}
+
+	return nil
+}
+
+// boundedBuffer is an io.Writer that keeps at most one byte more than its
+// max (so that going over is detectable) and discards the rest, without
+// failing writes so that the writer is not interrupted.  A max of zero is
+// unlimited.
+type boundedBuffer struct {
+	buf bytes.Buffer
+	max int
+}
+
+func (bb *boundedBuffer) Write(p []byte) (int, error) {
+	if bb.max > 0 {
+		room := bb.max + 1 - bb.buf.Len()
+		if room <= 0 {
+			return len(p), nil
+		}
+		if len(p) > room {
+			bb.buf.Write(p[:room])
+			return len(p), nil
+		}
+	}
+
+	return bb.buf.Write(p)
+}
+
+func (bb *boundedBuffer) Bytes() []byte {
+	return bb.buf.Bytes()
+}
+
+// readBounded reads everything from the reader, keeping at most one byte
+// more than max
+func readBounded(r io.Reader, max int) ([]byte, error) {
+	bb := &boundedBuffer{max: max}
+	_, err := io.Copy(bb, r)
+	return bb.Bytes(), err
+}
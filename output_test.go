@@ -0,0 +1,157 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const strayOutputHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+
+payload = json.load(sys.stdin)
+payload[os.path.basename(sys.argv[0])] = True
+if os.path.basename(sys.argv[0]).startswith('10-'):
+    print('debugging output')
+    sys.stdout.write('x' * int(os.environ.get('OUTPUT_PADDING') or 0))
+json.dump(payload, sys.stdout)
+`
+
+func setupOutputWormDir(t *testing.T) (string, *HandlerConfig) {
+	dir := newJournalTestDir(t)
+
+	for _, name := range []string{"10-stray.py", "20-clean.py"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(strayOutputHandlerBody), 0755)
+	}
+
+	validate := true
+	return dir, &HandlerConfig{WormDir: dir, WormTimeout: 10, Output: &OutputPolicy{JSON: &validate}}
+}
+
+func TestOutputPolicyFailsStage(t *testing.T) {
+	dir, cfg := setupOutputWormDir(t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := &Delivery{Source: "github"}
+	_, err = pipeline.HandlePayload(delivery, `{"input":true}`)
+	if err == nil || !strings.HasPrefix(err.Error(), "10-stray.py: invalid output: not JSON") {
+		t.Errorf("expected invalid output error naming the handler, got %v", err)
+	}
+
+	if len(delivery.Results) != 1 || delivery.Results[0].Status != resultFailed {
+		t.Errorf("expected only the failed stage to run: %+v", delivery.Results)
+	}
+}
+
+func TestOutputPolicyPassesInputAlong(t *testing.T) {
+	dir, cfg := setupOutputWormDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg.Output.OnInvalid = outputInput
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := &Delivery{Source: "github"}
+	out, err := pipeline.HandlePayload(delivery, `{"input":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out, "10-stray.py") || !strings.Contains(out, `"20-clean.py": true`) {
+		t.Errorf("expected the stray handler's input to be passed along: %q", out)
+	}
+
+	if len(delivery.Results) != 2 || delivery.Results[0].Status != resultUnchanged ||
+		!strings.Contains(delivery.Results[0].Error, "invalid output") {
+		t.Errorf("expected the invalid output to be recorded: %+v", delivery.Results[0])
+	}
+}
+
+func TestOutputPolicyMaxSize(t *testing.T) {
+	dir, cfg := setupOutputWormDir(t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("OUTPUT_PADDING", "100000")
+	defer os.Setenv("OUTPUT_PADDING", "")
+
+	cfg.Output = &OutputPolicy{MaxSize: 1024}
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = pipeline.HandlePayload(&Delivery{Source: "github"}, `{"input":true}`)
+	if err == nil || err.Error() != "10-stray.py: invalid output: exceeds 1024 bytes" {
+		t.Errorf("expected oversized output error, got %v", err)
+	}
+}
+
+func TestManifestOutputOverride(t *testing.T) {
+	dir, cfg := setupOutputWormDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, wormManifestName), []byte(`{"handlers": [
+		{"command": "10-stray.py", "output": {"json": false}},
+		{"command": "20-clean.py"}
+	]}`), 0644)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{"input":true}`)
+	if err == nil || !strings.HasPrefix(err.Error(), "20-clean.py:") {
+		t.Errorf("expected the stray output to reach and fail the next handler, got %q %v", out, err)
+	}
+}
+
+func TestOutputPolicyMerge(t *testing.T) {
+	validate := true
+	global := &OutputPolicy{MaxSize: 100, JSON: &validate, OnInvalid: outputInput}
+
+	noValidate := false
+	merged := global.merge(&OutputPolicy{JSON: &noValidate})
+	if merged.MaxSize != 100 || *merged.JSON || merged.OnInvalid != outputInput || !*global.JSON {
+		t.Errorf("unexpected merge %+v", merged)
+	}
+
+	if merged := (*OutputPolicy)(nil).merge(nil); merged.OnInvalid != outputFail || merged.MaxSize != 0 {
+		t.Errorf("unexpected default policy %+v", merged)
+	}
+
+	if err := (&OutputPolicy{OnInvalid: "ignore"}).validate(); err == nil {
+		t.Errorf("expected unknown on_invalid to be rejected")
+	}
+}
+
+func TestBoundedBuffer(t *testing.T) {
+	b, err := readBounded(strings.NewReader(strings.Repeat("x", 100)), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 11 {
+		t.Errorf("expected one byte past the max to be kept, got %d", len(b))
+	}
+
+	b, _ = readBounded(strings.NewReader("short"), 0)
+	if string(b) != "short" {
+		t.Errorf("expected unlimited read, got %q", b)
+	}
+}
@@ -0,0 +1,111 @@
+package hookworm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// HandlerFactory builds a native Go handler for a pipeline.  It is called
+// each time a pipeline that refers to the handler is built, including when
+// the worm dir is reloaded.
+type HandlerFactory func(cfg *HandlerConfig) (Handler, error)
+
+var (
+	handlerRegistryMu sync.RWMutex
+	handlerRegistry   = map[string]HandlerFactory{}
+)
+
+// RegisterHandler makes a native Go handler available by name so that it
+// may be added to the pipeline via `-handler` or the `handler` key of a
+// worm manifest entry.  It is intended to be called from an `init`
+// function, and panics if the name is already registered or the factory
+// is nil.
+func RegisterHandler(name string, factory HandlerFactory) {
+	handlerRegistryMu.Lock()
+	defer handlerRegistryMu.Unlock()
+
+	if factory == nil {
+		panic("hookworm: RegisterHandler factory is nil")
+	}
+
+	if name == "" || strings.ContainsAny(name, " \t;,") {
+		panic(fmt.Sprintf("hookworm: invalid handler name %q", name))
+	}
+
+	if _, dup := handlerRegistry[name]; dup {
+		panic(fmt.Sprintf("hookworm: RegisterHandler called twice for %q", name))
+	}
+
+	handlerRegistry[name] = factory
+}
+
+// RegisteredHandlers returns the sorted names of all registered native
+// handlers
+func RegisteredHandlers() []string {
+	handlerRegistryMu.RLock()
+	defer handlerRegistryMu.RUnlock()
+
+	var names []string
+	for name := range handlerRegistry {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func lookupHandlerFactory(name string) (HandlerFactory, bool) {
+	handlerRegistryMu.RLock()
+	defer handlerRegistryMu.RUnlock()
+
+	factory, ok := handlerRegistry[name]
+	return factory, ok
+}
+
+// newRegisteredHandler builds the registered native handler of the given
+// name
+func newRegisteredHandler(name string, cfg *HandlerConfig) (Handler, error) {
+	factory, ok := lookupHandlerFactory(name)
+	if !ok {
+		return nil, fmt.Errorf("no handler registered as %q (registered: %v)", name, RegisteredHandlers())
+	}
+
+	handler, err := factory(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build handler %q: %v", name, err)
+	}
+
+	if handler == nil {
+		return nil, fmt.Errorf("failed to build handler %q: factory returned nil", name)
+	}
+
+	return handler, nil
+}
+
+// handlerNameList is a list of registered handler names usable as a
+// repeatable flag value
+type handlerNameList []string
+
+func (hnl *handlerNameList) String() string {
+	return strings.Join(*hnl, ";")
+}
+
+// Set accepts one or more handler names separated by `;`
+func (hnl *handlerNameList) Set(value string) error {
+	for _, name := range strings.Split(value, ";") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		if _, ok := lookupHandlerFactory(name); !ok {
+			return fmt.Errorf("no handler registered as %q", name)
+		}
+
+		*hnl = append(*hnl, name)
+	}
+
+	return nil
+}
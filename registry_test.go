@@ -0,0 +1,158 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+type nativeTestHandler struct {
+	name string
+	next Handler
+}
+
+func init() {
+	RegisterHandler("test-native", func(cfg *HandlerConfig) (Handler, error) {
+		return &nativeTestHandler{name: "test-native"}, nil
+	})
+	RegisterHandler("test-broken", func(cfg *HandlerConfig) (Handler, error) {
+		return nil, fmt.Errorf("no can do")
+	})
+}
+
+func (nth *nativeTestHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(payload), &obj); err != nil {
+		return payload, err
+	}
+
+	seen, _ := obj["seen"].([]interface{})
+	obj["seen"] = append(seen, map[string]interface{}{"native": nth.name})
+
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return payload, err
+	}
+
+	if nth.next != nil {
+		return nth.next.HandlePayload(delivery, string(out))
+	}
+	return string(out), nil
+}
+
+func (nth *nativeTestHandler) SetNextHandler(n Handler) {
+	nth.next = n
+}
+
+func (nth *nativeTestHandler) NextHandler() Handler {
+	return nth.next
+}
+
+func expectRegisterHandlerPanic(name string, factory HandlerFactory, t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected registration of %q to panic", name)
+		}
+	}()
+	RegisterHandler(name, factory)
+}
+
+func TestRegisterHandler(t *testing.T) {
+	factory := func(cfg *HandlerConfig) (Handler, error) { return nil, nil }
+
+	expectRegisterHandlerPanic("test-native", factory, t)
+	expectRegisterHandlerPanic("test-nil", nil, t)
+	expectRegisterHandlerPanic("bad;name", factory, t)
+
+	if names := strings.Join(RegisteredHandlers(), " "); !strings.Contains(names, "test-broken test-native") {
+		t.Errorf("unexpected registered handlers %v", names)
+	}
+}
+
+func TestNewHandlerPipelineWithRegisteredHandlers(t *testing.T) {
+	pipeline, err := NewHandlerPipeline(&HandlerConfig{Handlers: []string{"test-native", "test-native"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != `{"seen":[{"native":"test-native"},{"native":"test-native"}]}` {
+		t.Errorf("unexpected output %s", out)
+	}
+
+	if _, err := NewHandlerPipeline(&HandlerConfig{Handlers: []string{"test-broken"}}); err == nil {
+		t.Errorf("expected factory error to fail the pipeline")
+	}
+	if _, err := NewHandlerPipeline(&HandlerConfig{Handlers: []string{"test-missing"}}); err == nil {
+		t.Errorf("expected unregistered handler to fail the pipeline")
+	}
+}
+
+func TestManifestRegisteredHandler(t *testing.T) {
+	dir, cfg := setupManifestWormDir(`{
+  "handlers": [
+    {"command": "argv.py"},
+    {"handler": "test-native"},
+    {"command": "10-argv.py"},
+    {"command": "20-fails.py", "enabled": false}
+  ]
+}`, t)
+	defer os.RemoveAll(dir)
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := pipeline.HandlePayload(&Delivery{Source: "github", Event: "push"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := &struct {
+		Seen []struct {
+			Native string `json:"native"`
+		} `json:"seen"`
+	}{}
+	if err := json.Unmarshal([]byte(out), seen); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen.Seen) != 3 || seen.Seen[1].Native != "test-native" || seen.Seen[0].Native != "" {
+		t.Errorf("expected native handler between shell handlers, got %s", out)
+	}
+	if len(shellHandlers(pipeline)) != 2 {
+		t.Errorf("unexpected shell handlers %+v", shellHandlers(pipeline))
+	}
+}
+
+func TestManifestRejectsInvalidRegisteredHandlers(t *testing.T) {
+	for _, manifest := range []string{
+		`{"handlers": [{"handler": "test-missing"}]}`,
+		`{"handlers": [{"handler": "test-native", "command": "argv.py"}]}`,
+		`{"handlers": [{"handler": "test-native", "group": "g"}]}`,
+	} {
+		dir, cfg := setupManifestWormDir(manifest, t)
+		if _, err := NewHandlerPipeline(cfg); err == nil {
+			t.Errorf("expected %s to be rejected", manifest)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestHandlerNameList(t *testing.T) {
+	hnl := handlerNameList{}
+	if err := hnl.Set("test-native; test-broken;"); err != nil {
+		t.Fatal(err)
+	}
+	if hnl.String() != "test-native;test-broken" {
+		t.Errorf("unexpected handler names %q", hnl.String())
+	}
+	if err := hnl.Set("test-missing"); err == nil {
+		t.Errorf("expected unregistered handler to be rejected")
+	}
+}
@@ -0,0 +1,264 @@
+package hookworm
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// wormFileState is what we know about a file in the worm dir when deciding
+// whether it has changed
+type wormFileState struct {
+	modTime time.Time
+	size    int64
+	mode    os.FileMode
+}
+
+type wormDirSnapshot map[string]wormFileState
+
+func takeWormDirSnapshot(wormDir string) (wormDirSnapshot, error) {
+	snapshot := wormDirSnapshot{}
+	if wormDir == "" {
+		return snapshot, nil
+	}
+
+	directory, err := os.Open(wormDir)
+	if err != nil {
+		return nil, err
+	}
+	defer directory.Close()
+
+	infos, err := directory.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range infos {
+		snapshot[path.Join(wormDir, fi.Name())] = wormFileState{
+			modTime: fi.ModTime(),
+			size:    fi.Size(),
+			mode:    fi.Mode(),
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (wds wormDirSnapshot) equal(other wormDirSnapshot) bool {
+	if len(wds) != len(other) {
+		return false
+	}
+
+	for name, state := range wds {
+		if otherState, ok := other[name]; !ok || otherState != state {
+			return false
+		}
+	}
+
+	return true
+}
+
+// reloadablePipeline is a Handler that forwards each payload to the current
+// handler pipeline, which may be rebuilt from the worm dir and swapped in
+// at any time.  Deliveries that are already in flight finish on the
+// pipeline they started on.
+type reloadablePipeline struct {
+	sync.RWMutex
+	cfg      *HandlerConfig
+	current  Handler
+	snapshot wormDirSnapshot
+
+	reloading sync.Mutex
+}
+
+func newReloadablePipeline(cfg *HandlerConfig) (*reloadablePipeline, error) {
+	snapshot, err := takeWormDirSnapshot(cfg.WormDir)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	handlers := shellHandlers(pipeline)
+	statuses := configureHandlers(handlers)
+	if err := configureError(statuses); err != nil {
+		if cfg.Strict {
+			for _, sh := range handlers {
+				sh.stopWorker()
+			}
+			return nil, err
+		}
+		logger.Printf("ERROR: %v\n", err)
+	}
+
+	logger.Printf("Configured %d handlers\n", len(statuses))
+
+	return &reloadablePipeline{
+		cfg:      cfg,
+		current:  pipeline,
+		snapshot: snapshot,
+	}, nil
+}
+
+func (rp *reloadablePipeline) pipeline() Handler {
+	rp.RLock()
+	defer rp.RUnlock()
+
+	return rp.current
+}
+
+func (rp *reloadablePipeline) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	return rp.pipeline().HandlePayload(delivery, payload)
+}
+
+func (rp *reloadablePipeline) SetNextHandler(n Handler) {
+	rp.pipeline().SetNextHandler(n)
+}
+
+func (rp *reloadablePipeline) NextHandler() Handler {
+	return rp.pipeline().NextHandler()
+}
+
+// reloadIfChanged reloads the pipeline if anything in the worm dir has
+// changed since the last reload
+func (rp *reloadablePipeline) reloadIfChanged() error {
+	snapshot, err := takeWormDirSnapshot(rp.cfg.WormDir)
+	if err != nil {
+		return err
+	}
+
+	rp.RLock()
+	unchanged := snapshot.equal(rp.snapshot)
+	rp.RUnlock()
+
+	if unchanged {
+		return nil
+	}
+
+	return rp.reload()
+}
+
+// reload rebuilds the pipeline from the worm dir, configures any handlers
+// that are new, have changed or previously failed to configure, and swaps
+// the new pipeline in.  Handlers that have not changed keep the
+// configuration they already declared.  The current pipeline is left in
+// place if the new one cannot be built.
+func (rp *reloadablePipeline) reload() error {
+	rp.reloading.Lock()
+	defer rp.reloading.Unlock()
+
+	snapshot, err := takeWormDirSnapshot(rp.cfg.WormDir)
+	if err != nil {
+		logger.Printf("ERROR: failed to reload worm dir %v: %v\n", rp.cfg.WormDir, err)
+		return err
+	}
+
+	pipeline, err := NewHandlerPipeline(rp.cfg)
+	if err != nil {
+		logger.Printf("ERROR: failed to reload worm dir %v, keeping current handlers: %v\n", rp.cfg.WormDir, err)
+		return err
+	}
+
+	rp.RLock()
+	oldHandlers := shellHandlersByKey(rp.current)
+	oldSnapshot := rp.snapshot
+	rp.RUnlock()
+
+	manifestPath := path.Join(rp.cfg.WormDir, wormManifestName)
+	manifestChanged := oldSnapshot[manifestPath] != snapshot[manifestPath]
+
+	var (
+		added, removed, changed []string
+		unconfigured            []*shellHandler
+	)
+
+	newHandlers := shellHandlersByKey(pipeline)
+	for key, sh := range newHandlers {
+		old, ok := oldHandlers[key]
+		filePath := sh.command.filePath
+		switch {
+		case !ok:
+			added = append(added, key)
+		case manifestChanged || oldSnapshot[filePath] != snapshot[filePath]:
+			changed = append(changed, key)
+		case old.configureStatus().State != handlerFailed:
+			sh.adopt(old)
+			continue
+		}
+
+		unconfigured = append(unconfigured, sh)
+	}
+
+	configureHandlers(unconfigured)
+
+	for key := range oldHandlers {
+		if _, ok := newHandlers[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+
+	rp.Lock()
+	rp.current = pipeline
+	rp.snapshot = snapshot
+	rp.Unlock()
+
+	for key, old := range oldHandlers {
+		if sh, ok := newHandlers[key]; !ok || sh.worker != old.worker {
+			old.stopWorker()
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+
+	logger.Printf("Reloaded worm dir %v with %d handlers (added: %v, removed: %v, changed: %v)\n",
+		rp.cfg.WormDir, len(newHandlers), added, removed, changed)
+	return nil
+}
+
+// watch polls the worm dir for changes at the given interval
+func (rp *reloadablePipeline) watch(interval time.Duration) {
+	logger.Debugf("Watching worm dir %v for changes every %v\n", rp.cfg.WormDir, interval)
+
+	for _ = range time.Tick(interval) {
+		if err := rp.reloadIfChanged(); err != nil {
+			logger.Debugf("Failed to check worm dir for changes: %v\n", err)
+		}
+	}
+}
+
+// reloadOnSignal reloads the pipeline whenever the given signal arrives
+func (rp *reloadablePipeline) reloadOnSignal(sig os.Signal) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, sig)
+
+	for _ = range signals {
+		logger.Printf("Received %v, reloading worm dir\n", sig)
+		rp.reload()
+	}
+}
+
+// shellHandlersByKey returns the shell handlers in the pipeline keyed by
+// the path of their handler files.  A manifest may list the same command
+// more than once (e.g. with different args), so every occurrence after the
+// first is keyed by its path and occurrence, e.g. `/worm.d/notify.py #2`.
+func shellHandlersByKey(pipeline Handler) map[string]*shellHandler {
+	handlers := map[string]*shellHandler{}
+	seen := map[string]int{}
+	for _, sh := range shellHandlers(pipeline) {
+		key := sh.command.filePath
+		if seen[key]++; seen[key] > 1 {
+			key = fmt.Sprintf("%s #%d", key, seen[key])
+		}
+		handlers[key] = sh
+	}
+	return handlers
+}
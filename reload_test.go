@@ -0,0 +1,112 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func setupReloadWormDir(t *testing.T) (string, *reloadablePipeline) {
+	dir := newJournalTestDir(t)
+	ioutil.WriteFile(filepath.Join(dir, "10-argv.py"), []byte(manifestArgvHandlerBody), 0755)
+
+	rp, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, rp
+}
+
+func TestWormDirSnapshotEqual(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "a.py"), []byte("a"), 0755)
+	before, _ := takeWormDirSnapshot(dir)
+	same, _ := takeWormDirSnapshot(dir)
+	if !before.equal(same) {
+		t.Errorf("expected snapshots to be equal")
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a.py"), []byte("ab"), 0755)
+	after, _ := takeWormDirSnapshot(dir)
+	if before.equal(after) {
+		t.Errorf("expected changed snapshot to differ")
+	}
+}
+
+func TestReloadablePipelineReloadsChangedWormDir(t *testing.T) {
+	dir, rp := setupReloadWormDir(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := rp.HandlePayload(&Delivery{Source: "github"}, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	old := rp.pipeline()
+	oldHandler := old.NextHandler().(*shellHandler)
+
+	if err := rp.reloadIfChanged(); err != nil || rp.pipeline() != old {
+		t.Fatalf("expected unchanged worm dir not to be reloaded: %v", err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "20-argv.py"), []byte(manifestArgvHandlerBody), 0755)
+
+	if err := rp.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rp.pipeline() == old {
+		t.Fatalf("expected pipeline to be swapped")
+	}
+
+	handlers := shellHandlersByKey(rp.pipeline())
+	if len(handlers) != 2 {
+		t.Fatalf("unexpected handlers %+v", handlers)
+	}
+
+	unchanged := handlers[oldHandler.command.filePath]
+	if unchanged == oldHandler || !unchanged.configured || strings.Join(unchanged.events, ",") != "push" {
+		t.Errorf("expected unchanged handler to adopt configuration, got %+v", unchanged)
+	}
+
+	added := handlers[filepath.Join(dir, "20-argv.py")]
+	if !added.configured || strings.Join(added.events, ",") != "push" {
+		t.Errorf("expected new handler to be configured, got %+v", added)
+	}
+
+	if old.NextHandler().NextHandler() != nil {
+		t.Errorf("old pipeline was modified by reload")
+	}
+
+	out, err := rp.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	if err != nil || strings.Count(out, "argv") != 2 {
+		t.Errorf("unexpected output from reloaded pipeline %q %v", out, err)
+	}
+
+	os.Remove(filepath.Join(dir, "10-argv.py"))
+	if err := rp.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if len(shellHandlersByKey(rp.pipeline())) != 1 {
+		t.Errorf("expected removed handler to be dropped")
+	}
+}
+
+func TestReloadablePipelineKeepsPipelineOnError(t *testing.T) {
+	dir, rp := setupReloadWormDir(t)
+	defer os.RemoveAll(dir)
+
+	old := rp.pipeline()
+	ioutil.WriteFile(filepath.Join(dir, wormManifestName), []byte(`{"handlers": [{}]}`), 0644)
+
+	if err := rp.reloadIfChanged(); err == nil {
+		t.Errorf("expected invalid manifest to fail reload")
+	}
+	if rp.pipeline() != old {
+		t.Errorf("expected current pipeline to be kept")
+	}
+}
@@ -0,0 +1,129 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	resultChanged   = "changed"
+	resultUnchanged = "unchanged"
+	resultNoop      = "noop"
+	resultTempfail  = "tempfail"
+	resultFailed    = "failed"
+	resultTimeout   = "timeout"
+
+	// resultUnconfigured is a handler skipped because it failed to
+	// configure
+	resultUnconfigured = "unconfigured"
+
+	// resultFD is the file descriptor on which handlers may write a result
+	// envelope
+	resultFD = 3
+
+	// resultEnvelopeOverhead is how far a result envelope may exceed the
+	// output max to make room for everything but the payload
+	resultEnvelopeOverhead = 64 << 10
+)
+
+// HandlerResult records what a single handler did with a delivery, along
+// with anything it reported via a result envelope and the tail of its
+// standard error
+type HandlerResult struct {
+	Handler     string                 `json:"handler"`
+	Status      string                 `json:"status"`
+	Stop        bool                   `json:"stop,omitempty"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	Messages    []string               `json:"messages,omitempty"`
+	Error       string                 `json:"error,omitempty"`
+	Stderr      string                 `json:"stderr,omitempty"`
+}
+
+// resultEnvelope is the optional JSON object a handler may write to
+// resultFD (or include in a persistent worker response) in addition to
+// exiting
+type resultEnvelope struct {
+	Payload     json.RawMessage        `json:"payload"`
+	Stop        bool                   `json:"stop"`
+	Annotations map[string]interface{} `json:"annotations"`
+	Messages    []string               `json:"messages"`
+	Status      string                 `json:"status"`
+}
+
+// envelopeFailure is a handler that reported failure via its result
+// envelope
+type envelopeFailure struct {
+	messages []string
+}
+
+func (e *envelopeFailure) Error() string {
+	if len(e.messages) == 0 {
+		return "reported failure"
+	}
+	return "reported failure: " + strings.Join(e.messages, "; ")
+}
+
+// handlerOutput is everything produced by a single run of a handler
+type handlerOutput struct {
+	out      []byte
+	stderr   []byte
+	envelope *resultEnvelope
+}
+
+// handlerOutcome is what the pipeline does next after a handler has run
+type handlerOutcome struct {
+	payload string
+	handled bool
+	stop    bool
+}
+
+func parseResultEnvelope(b []byte) (*resultEnvelope, error) {
+	if len(strings.TrimSpace(string(b))) == 0 {
+		return nil, nil
+	}
+
+	envelope := &resultEnvelope{}
+	if err := json.Unmarshal(b, envelope); err != nil {
+		return nil, fmt.Errorf("invalid result envelope: %v", err)
+	}
+
+	switch envelope.Status {
+	case "", resultChanged, resultUnchanged, resultNoop, resultTempfail, resultFailed:
+	default:
+		return nil, fmt.Errorf("invalid result envelope: unknown status %q", envelope.Status)
+	}
+
+	return envelope, nil
+}
+
+// payload returns the payload given in the envelope, if any.  A JSON string
+// is taken to be the payload itself, and any other JSON value is used
+// verbatim.
+func (re *resultEnvelope) payload() (string, bool) {
+	if len(re.Payload) == 0 || string(re.Payload) == "null" {
+		return "", false
+	}
+
+	var s string
+	if err := json.Unmarshal(re.Payload, &s); err == nil {
+		return s, true
+	}
+
+	return string(re.Payload), true
+}
+
+// statusError returns the error corresponding to the envelope's status,
+// which is only consulted when the handler otherwise succeeded
+func (re *resultEnvelope) statusError() error {
+	switch re.Status {
+	case resultNoop:
+		return &exitNoop{}
+	case resultTempfail:
+		return &exitTempfail{}
+	case resultFailed:
+		return &envelopeFailure{messages: re.Messages}
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,245 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const resultHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+
+payload = json.load(sys.stdin)
+payload[os.path.basename(sys.argv[0])] = True
+json.dump(payload, sys.stdout)
+
+envelope = os.environ.get('RESULT_ENVELOPE_' + os.path.basename(sys.argv[0]).split('-')[0])
+if envelope:
+    result = os.fdopen(int(os.environ['HOOKWORM_RESULT_FD']), 'w')
+    result.write(envelope)
+    result.flush()
+    if os.environ.get('RESULT_BACKGROUND'):
+        os.system('(sleep 8 >/dev/null 2>&1 &)')
+    result.close()
+
+sys.exit(0)
+`
+
+func setupResultWormDir(names []string, t *testing.T) (string, *HandlerConfig) {
+	dir := newJournalTestDir(t)
+
+	for _, name := range names {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(resultHandlerBody), 0755)
+	}
+
+	return dir, &HandlerConfig{WormDir: dir, WormTimeout: 10}
+}
+
+func handleResultPayload(cfg *HandlerConfig, t *testing.T) (*Delivery, string, error) {
+	pipeline, err := NewHandlerPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	delivery := &Delivery{ID: "result-test", Source: "github"}
+	out, err := pipeline.HandlePayload(delivery, `{"input":true}`)
+	return delivery, out, err
+}
+
+func TestResultEnvelopeStopsPipeline(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py", "20-b.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"stop":true,"annotations":{"build":42},"messages":["nothing more to do"]}`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	delivery, out, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, `"10-a.py"`) || strings.Contains(out, `"20-b.py"`) {
+		t.Errorf("expected pipeline to stop after 10-a.py: %q", out)
+	}
+
+	if len(delivery.Results) != 1 {
+		t.Fatalf("expected 1 result: %+v", delivery.Results)
+	}
+
+	result := delivery.Results[0]
+	if filepath.Base(result.Handler) != "10-a.py" || result.Status != resultChanged || !result.Stop {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	if result.Annotations["build"] != float64(42) {
+		t.Errorf("expected annotations to be recorded: %+v", result.Annotations)
+	}
+
+	if len(result.Messages) != 1 || result.Messages[0] != "nothing more to do" {
+		t.Errorf("expected messages to be recorded: %+v", result.Messages)
+	}
+}
+
+func TestResultEnvelopePayload(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py", "20-b.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"payload":{"replaced":true}}`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	delivery, out, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, `"replaced": true`) || strings.Contains(out, `"10-a.py"`) {
+		t.Errorf("expected envelope payload to replace stdout: %q", out)
+	}
+
+	if len(delivery.Results) != 2 {
+		t.Errorf("expected 2 results: %+v", delivery.Results)
+	}
+}
+
+func TestResultEnvelopeUnchanged(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"status":"unchanged"}`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	delivery, out, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if out != `{"input":true}` {
+		t.Errorf("expected payload to pass through unchanged: %q", out)
+	}
+
+	if len(delivery.Results) != 1 || delivery.Results[0].Status != resultUnchanged {
+		t.Errorf("unexpected results: %+v", delivery.Results)
+	}
+}
+
+func TestResultEnvelopeNoop(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py", "20-b.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"status":"noop"}`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	delivery, out, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(out, `"10-a.py"`) || !strings.Contains(out, `"20-b.py"`) {
+		t.Errorf("expected 10-a.py output to be discarded: %q", out)
+	}
+
+	if len(delivery.Results) != 2 || delivery.Results[0].Status != resultNoop {
+		t.Errorf("unexpected results: %+v", delivery.Results)
+	}
+}
+
+func TestResultEnvelopeFailed(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py", "20-b.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"status":"failed","messages":["bad payload"]}`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	delivery, _, err := handleResultPayload(cfg, t)
+	if err == nil || !strings.Contains(err.Error(), "bad payload") {
+		t.Errorf("expected reported failure, got %v", err)
+	}
+
+	if len(delivery.Results) != 1 || delivery.Results[0].Status != resultFailed {
+		t.Errorf("unexpected results: %+v", delivery.Results)
+	}
+}
+
+func TestResultEnvelopeInvalid(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py"}, t)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"stop":`)
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+
+	_, _, err := handleResultPayload(cfg, t)
+	if err == nil || !strings.Contains(err.Error(), "invalid result envelope") {
+		t.Errorf("expected invalid envelope error, got %v", err)
+	}
+}
+
+func TestResultRecordedWithoutEnvelope(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py"}, t)
+	defer os.RemoveAll(dir)
+
+	delivery, _, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(delivery.Results) != 1 || delivery.Results[0].Status != resultChanged {
+		t.Errorf("unexpected results: %+v", delivery.Results)
+	}
+}
+
+func TestResultEnvelopeWithBackgroundedChild(t *testing.T) {
+	dir, cfg := setupResultWormDir([]string{"10-a.py"}, t)
+	defer os.RemoveAll(dir)
+	cfg.WormTimeout = 2
+
+	os.Setenv("RESULT_ENVELOPE_10", `{"annotations":{"build":42}}`)
+	os.Setenv("RESULT_BACKGROUND", "1")
+	defer os.Setenv("RESULT_ENVELOPE_10", "")
+	defer os.Setenv("RESULT_BACKGROUND", "")
+
+	start := time.Now()
+	delivery, _, err := handleResultPayload(cfg, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("expected the handler not to wait for its backgrounded child, took %v", elapsed)
+	}
+
+	if delivery.Results[0].Annotations["build"] != float64(42) {
+		t.Errorf("expected the envelope written before exiting to be read: %+v", delivery.Results[0])
+	}
+}
+
+func TestParseResultEnvelope(t *testing.T) {
+	envelope, err := parseResultEnvelope([]byte("  \n"))
+	if envelope != nil || err != nil {
+		t.Errorf("expected no envelope for blank input: %+v %v", envelope, err)
+	}
+
+	if _, err := parseResultEnvelope([]byte(`{"status":"bogus"}`)); err == nil {
+		t.Errorf("expected unknown status to be rejected")
+	}
+
+	envelope, err = parseResultEnvelope([]byte(`{"payload":"raw text"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := envelope.payload(); !ok || p != "raw text" {
+		t.Errorf("expected string payload to be unquoted: %q", p)
+	}
+
+	envelope, _ = parseResultEnvelope([]byte(`{"payload":null}`))
+	if _, ok := envelope.payload(); ok {
+		t.Errorf("expected null payload to be absent")
+	}
+}
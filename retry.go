@@ -0,0 +1,77 @@
+package hookworm
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy describes how many times, and how patiently, a handler is
+// retried after a transient failure such as exiting 75 (EX_TEMPFAIL) or
+// timing out.  Delays are given in seconds.
+type RetryPolicy struct {
+	MaxAttempts  int     `json:"max_attempts"`
+	InitialDelay float64 `json:"initial_delay"`
+	Backoff      float64 `json:"backoff"`
+	Jitter       float64 `json:"jitter"`
+}
+
+// merge returns a copy of the policy with any non-zero fields of the other
+// policy taking precedence
+func (rp *RetryPolicy) merge(other *RetryPolicy) *RetryPolicy {
+	merged := &RetryPolicy{MaxAttempts: 1, Backoff: 1}
+	if rp != nil {
+		*merged = *rp
+	}
+
+	if other == nil {
+		return merged
+	}
+
+	if other.MaxAttempts > 0 {
+		merged.MaxAttempts = other.MaxAttempts
+	}
+	if other.InitialDelay > 0 {
+		merged.InitialDelay = other.InitialDelay
+	}
+	if other.Backoff > 0 {
+		merged.Backoff = other.Backoff
+	}
+	if other.Jitter > 0 {
+		merged.Jitter = other.Jitter
+	}
+
+	return merged
+}
+
+// delay returns how long to wait after the given (1-based) failed attempt
+func (rp *RetryPolicy) delay(attempt int) time.Duration {
+	backoff := rp.Backoff
+	if backoff < 1 {
+		backoff = 1
+	}
+
+	seconds := rp.InitialDelay * math.Pow(backoff, float64(attempt-1))
+
+	if rp.Jitter > 0 {
+		seconds *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	}
+
+	if seconds < 0 {
+		seconds = 0
+	}
+
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// isTransient is true for handler errors that are worth retrying
+func isTransient(err error) bool {
+	switch e := err.(type) {
+	case *exitTempfail, *exitTimeout:
+		return true
+	case *forwardError:
+		return e.transient
+	default:
+		return false
+	}
+}
@@ -0,0 +1,57 @@
+package hookworm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyMergeDefaults(t *testing.T) {
+	var rp *RetryPolicy
+	merged := rp.merge(nil)
+	if merged.MaxAttempts != 1 || merged.InitialDelay != 0 {
+		t.Errorf("unexpected default policy %+v", merged)
+	}
+}
+
+func TestRetryPolicyMergeOverridesNonZeroFields(t *testing.T) {
+	global := &RetryPolicy{MaxAttempts: 2, InitialDelay: 1, Backoff: 2, Jitter: 0.1}
+	merged := global.merge(&RetryPolicy{MaxAttempts: 5, Jitter: 0.5})
+
+	if merged.MaxAttempts != 5 || merged.InitialDelay != 1 || merged.Backoff != 2 || merged.Jitter != 0.5 {
+		t.Errorf("unexpected merged policy %+v", merged)
+	}
+	if global.MaxAttempts != 2 {
+		t.Errorf("merge modified the original policy")
+	}
+}
+
+func TestRetryPolicyDelayBacksOff(t *testing.T) {
+	rp := &RetryPolicy{InitialDelay: 0.5, Backoff: 3}
+	for attempt, expected := range map[int]time.Duration{
+		1: 500 * time.Millisecond,
+		2: 1500 * time.Millisecond,
+		3: 4500 * time.Millisecond,
+	} {
+		if d := rp.delay(attempt); d != expected {
+			t.Errorf("attempt %d: expected %v, got %v", attempt, expected, d)
+		}
+	}
+}
+
+func TestRetryPolicyDelayJitter(t *testing.T) {
+	rp := &RetryPolicy{InitialDelay: 1, Backoff: 1, Jitter: 0.25}
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(1); d < 750*time.Millisecond || d > 1250*time.Millisecond {
+			t.Fatalf("jittered delay %v out of range", d)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	if !isTransient(&exitTempfail{}) || !isTransient(&exitTimeout{timeout: 1}) {
+		t.Fail()
+	}
+	if isTransient(&exitNoop{}) || isTransient(nil) {
+		t.Fail()
+	}
+}
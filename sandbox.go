@@ -0,0 +1,309 @@
+package hookworm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	sandboxDirName = "sandbox"
+)
+
+var (
+	// defaultSandboxEnv is the environment passed to sandboxed handlers when
+	// no allowlist is given
+	defaultSandboxEnv = []string{"PATH", "LANG", "LC_*", "TZ"}
+)
+
+// SandboxProfile describes how handlers run on behalf of third parties are
+// contained.  Handlers run under a profile get only the allowlisted variables of hookworm's own
+// environment (entries ending in `*` match by prefix), a private directory
+// for each delivery as their temp, home and working directory, and
+// optionally a different user and group and new Linux namespaces (net, ipc,
+// uts, mount, pid and user).
+type SandboxProfile struct {
+	User       string   `json:"user,omitempty"`
+	Group      string   `json:"group,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	uid, gid       uint32
+	hasUID, hasGID bool
+	root           string
+}
+
+// merge returns a copy of the profile with any fields given in the other
+// profile taking precedence.  A nil profile stays nil unless the other is
+// given, since sandboxing is opt-in.
+func (sp *SandboxProfile) merge(other *SandboxProfile) *SandboxProfile {
+	if sp == nil && other == nil {
+		return nil
+	}
+
+	merged := &SandboxProfile{}
+	if sp != nil {
+		*merged = *sp
+	}
+
+	if other == nil {
+		return merged
+	}
+
+	if other.hasUID {
+		merged.User, merged.uid, merged.hasUID = other.User, other.uid, true
+		merged.Group = ""
+	}
+	if other.hasGID {
+		merged.Group, merged.gid, merged.hasGID = other.Group, other.gid, true
+	}
+	if other.Env != nil {
+		merged.Env = other.Env
+	}
+	if other.Namespaces != nil {
+		merged.Namespaces = other.Namespaces
+	}
+
+	return merged
+}
+
+// resolve looks up the user and group, which may be names or numeric IDs.
+// A user given without a group runs with the user's primary group.
+func (sp *SandboxProfile) resolve() error {
+	if sp.User != "" {
+		u, err := lookupSandboxUser(sp.User)
+		if err != nil {
+			return err
+		}
+
+		uid, _ := strconv.ParseUint(u.Uid, 10, 32)
+		gid, _ := strconv.ParseUint(u.Gid, 10, 32)
+		sp.uid, sp.hasUID = uint32(uid), true
+		sp.gid, sp.hasGID = uint32(gid), true
+	}
+
+	if sp.Group != "" {
+		gid, err := lookupSandboxGroup(sp.Group)
+		if err != nil {
+			return err
+		}
+		sp.gid, sp.hasGID = gid, true
+	}
+
+	for _, ns := range sp.Namespaces {
+		if _, ok := sandboxNamespaces[ns]; !ok {
+			return fmt.Errorf("unknown sandbox namespace %q (expected net, ipc, uts, mount, pid or user)", ns)
+		}
+	}
+
+	if len(sp.Namespaces) > 0 && !sandboxNamespacesSupported {
+		return fmt.Errorf("sandbox namespaces are only supported on linux")
+	}
+
+	return nil
+}
+
+func lookupSandboxUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		if u, err := user.LookupId(name); err == nil {
+			return u, nil
+		}
+		return &user.User{Uid: name, Gid: name, Username: name}, nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown sandbox user %q: %v", name, err)
+	}
+	return u, nil
+}
+
+func lookupSandboxGroup(name string) (uint32, error) {
+	if gid, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("unknown sandbox group %q: %v", name, err)
+	}
+
+	gid, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(gid), err
+}
+
+// environ returns the allowlisted variables of our own environment
+func (sp *SandboxProfile) environ() []string {
+	allowed := sp.Env
+	if allowed == nil {
+		allowed = defaultSandboxEnv
+	}
+
+	var env []string
+	for _, pair := range os.Environ() {
+		name := strings.SplitN(pair, "=", 2)[0]
+		for _, pattern := range allowed {
+			if name == pattern || (strings.HasSuffix(pattern, "*") && strings.HasPrefix(name, strings.TrimSuffix(pattern, "*"))) {
+				env = append(env, pair)
+				break
+			}
+		}
+	}
+
+	return env
+}
+
+// apply sets the credentials and namespaces the command runs with
+func (sp *SandboxProfile) apply(attr *syscall.SysProcAttr) {
+	if sp.hasUID || sp.hasGID {
+		uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+		if sp.hasUID {
+			uid = sp.uid
+		}
+		if sp.hasGID {
+			gid = sp.gid
+		}
+		attr.Credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+	}
+
+	sp.applyNamespaces(attr)
+}
+
+// newSandboxProfile returns the profile handlers run under given the
+// configured profile and any override, if either is given, rooted in the
+// working directory
+func newSandboxProfile(cfg *HandlerConfig, override *SandboxProfile) *SandboxProfile {
+	sp := cfg.Sandbox.merge(override)
+	if sp == nil {
+		return nil
+	}
+
+	workingDir := cfg.WorkingDir
+	if workingDir == "" {
+		workingDir = os.TempDir()
+	}
+
+	sp.root = filepath.Join(workingDir, sandboxDirName)
+	return sp
+}
+
+var (
+	// sharedSandboxRoot is the sandbox root used instead of the working
+	// directory's when the sandbox user cannot reach the latter
+	sharedSandboxRoot     string
+	sharedSandboxRootErr  error
+	sharedSandboxRootOnce sync.Once
+)
+
+// rootDir creates the sandbox root and returns it.  The root is kept in the
+// working directory unless handlers run as a user who cannot reach it, in
+// which case a dedicated root is created in the system temp directory
+// rather than opening up the working directory.
+func (sp *SandboxProfile) rootDir() (string, error) {
+	root := sp.root
+	if sp.hasUID {
+		if fi, err := os.Stat(filepath.Dir(root)); err == nil && fi.Mode().Perm()&0001 == 0 {
+			sharedSandboxRootOnce.Do(func() {
+				sharedSandboxRoot, sharedSandboxRootErr = ioutil.TempDir("", "hookworm-sandbox-")
+				if sharedSandboxRootErr == nil {
+					logger.Printf("Using sandbox directory %v, as %v is not accessible to sandbox users\n",
+						sharedSandboxRoot, filepath.Dir(root))
+				}
+			})
+			if sharedSandboxRootErr != nil {
+				return "", sharedSandboxRootErr
+			}
+			root = sharedSandboxRoot
+		}
+	}
+
+	if err := os.MkdirAll(root, 0711); err != nil {
+		return "", err
+	}
+	return root, os.Chmod(root, 0711)
+}
+
+// privateDir makes the directory owned by the sandbox user and accessible
+// to nobody else, returning the variables that point handlers at it
+func (sp *SandboxProfile) privateDir(dir string) (string, []string, error) {
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", nil, err
+	}
+
+	if sp.hasUID || sp.hasGID {
+		uid, gid := os.Getuid(), os.Getgid()
+		if sp.hasUID {
+			uid = int(sp.uid)
+		}
+		if sp.hasGID {
+			gid = int(sp.gid)
+		}
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return dir, []string{"TMPDIR=" + dir, "HOME=" + dir, "HOOKWORM_WORKING_DIR=" + dir}, nil
+}
+
+// subdir creates the named directory under the sandbox root, returning
+// the path
+func (sp *SandboxProfile) subdir(name string) (string, error) {
+	root, err := sp.rootDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(root, name)
+	if err := os.MkdirAll(dir, 0711); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// owner names the user a private directory belongs to, so that handlers
+// sandboxed as different users each get their own directory
+func (sp *SandboxProfile) owner() string {
+	if sp.hasUID {
+		return strconv.FormatUint(uint64(sp.uid), 10)
+	}
+	return "self"
+}
+
+// deliveryDir creates a new private directory for the handler to handle
+// the delivery in, which is removed once the delivery has been handled
+func (sp *SandboxProfile) deliveryDir(delivery *Delivery) (string, []string, error) {
+	id := delivery.ID
+	if id == "" {
+		id = "unidentified"
+	}
+
+	deliveries, err := sp.subdir("deliveries")
+	if err != nil {
+		return "", nil, err
+	}
+
+	dir, err := ioutil.TempDir(deliveries, safeFileName(id)+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	delivery.addTempDir(dir)
+
+	return sp.privateDir(dir)
+}
+
+// handlerDir creates the private directory used by a handler outside of a
+// delivery, i.e. when it is configured or runs as a persistent process
+func (sp *SandboxProfile) handlerDir(filePath string) (string, []string, error) {
+	dir, err := sp.subdir(filepath.Join("handlers", safeFileName(filepath.Base(filePath))+"-"+sp.owner()))
+	if err != nil {
+		return "", nil, err
+	}
+	return sp.privateDir(dir)
+}
@@ -0,0 +1,45 @@
+package hookworm
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	sandboxNamespacesSupported = true
+)
+
+var (
+	sandboxNamespaces = map[string]uintptr{
+		"net":   syscall.CLONE_NEWNET,
+		"ipc":   syscall.CLONE_NEWIPC,
+		"uts":   syscall.CLONE_NEWUTS,
+		"mount": syscall.CLONE_NEWNS,
+		"pid":   syscall.CLONE_NEWPID,
+		"user":  syscall.CLONE_NEWUSER,
+	}
+)
+
+// applyNamespaces starts the command in the profile's new namespaces.  In
+// a new user namespace, only the user and group the handler runs as are
+// mapped (to themselves), which also allows the other namespaces to be
+// created without privileges.
+func (sp *SandboxProfile) applyNamespaces(attr *syscall.SysProcAttr) {
+	for _, ns := range sp.Namespaces {
+		attr.Cloneflags |= sandboxNamespaces[ns]
+	}
+
+	if attr.Cloneflags&syscall.CLONE_NEWUSER == 0 {
+		return
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if attr.Credential != nil {
+		uid, gid = int(attr.Credential.Uid), int(attr.Credential.Gid)
+		attr.Credential.NoSetGroups = true
+	}
+
+	attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+	attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	attr.GidMappingsEnableSetgroups = false
+}
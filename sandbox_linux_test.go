@@ -0,0 +1,70 @@
+package hookworm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSandboxedHandlerRunsAsUser(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user requires root")
+	}
+
+	dir, _, out := runSandboxedHandler(&SandboxProfile{User: "65534"}, 0711, t)
+	defer os.RemoveAll(dir)
+
+	if out.UID != "65534" || out.Scratch != "scratch" {
+		t.Errorf("expected handler to run as uid 65534 with a private directory it owns: %+v", out)
+	}
+}
+
+func TestSandboxedHandlerLeavesWorkingDirClosed(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("changing user requires root")
+	}
+
+	dir, _, out := runSandboxedHandler(&SandboxProfile{User: "65534"}, 0750, t)
+	defer os.RemoveAll(dir)
+
+	if out.UID != "65534" || out.Scratch != "scratch" || strings.HasPrefix(out.TmpDir, dir+"/") {
+		t.Errorf("expected a private directory outside the inaccessible working directory: %+v", out)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0750 {
+		t.Errorf("expected the working directory to be left as it was, got %v", fi.Mode())
+	}
+}
+
+func TestSandboxedHandlerNamespaces(t *testing.T) {
+	sp := &SandboxProfile{Namespaces: []string{"user", "net", "uts"}}
+	if err := sp.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+	sp.root = dir
+
+	sc := newShellCommand("sh", "/dev/null", 5, 0)
+	sc.sandbox = sp
+
+	cmd := sc.newCmd("", nil)
+	cmd.Args = []string{"sh", "-c", "readlink /proc/self/ns/net; id -u"}
+	output, err := cmd.Output()
+	if err != nil {
+		t.Skipf("namespaces unavailable: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	ours, _ := os.Readlink("/proc/self/ns/net")
+	if len(lines) != 2 || lines[0] == ours || lines[1] != strconv.Itoa(os.Getuid()) {
+		t.Errorf("expected a new network namespace and the same user, got %q (ours %q)", output, ours)
+	}
+}
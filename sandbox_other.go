@@ -0,0 +1,19 @@
+// +build !linux
+
+package hookworm
+
+import (
+	"syscall"
+)
+
+const (
+	sandboxNamespacesSupported = false
+)
+
+var (
+	sandboxNamespaces = map[string]uintptr{
+		"net": 0, "ipc": 0, "uts": 0, "mount": 0, "pid": 0, "user": 0,
+	}
+)
+
+func (sp *SandboxProfile) applyNamespaces(attr *syscall.SysProcAttr) {}
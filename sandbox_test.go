@@ -0,0 +1,168 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sandboxHandlerBody = `#!/bin/sh
+if [ "$1" = configure ]; then
+    exit 0
+fi
+
+cat >/dev/null
+echo scratch > "$TMPDIR/scratch"
+echo '{}'
+printf '{"uid":"%s","tmpdir":"%s","home":"%s","working_dir":"%s","pwd":"%s","basic_auth":"%s","keep":"%s","scratch":"%s"}' \
+    "$(id -u)" "$TMPDIR" "$HOME" "$HOOKWORM_WORKING_DIR" "$(pwd)" "$HOOKWORM_BASIC_AUTH" "$SANDBOX_TEST_KEEP" \
+    "$(cat scratch)" >&2
+`
+
+type sandboxHandlerOutput struct {
+	UID        string `json:"uid"`
+	TmpDir     string `json:"tmpdir"`
+	Home       string `json:"home"`
+	WorkingDir string `json:"working_dir"`
+	Pwd        string `json:"pwd"`
+	BasicAuth  string `json:"basic_auth"`
+	Keep       string `json:"keep"`
+	Scratch    string `json:"scratch"`
+}
+
+// runSandboxedHandler handles a delivery with the sandbox handler under the
+// profile, from a working directory (dir/work) with the given permissions,
+// returning what the handler saw (as reported on its stderr)
+func runSandboxedHandler(sp *SandboxProfile, perm os.FileMode, t *testing.T) (string, *Delivery, *sandboxHandlerOutput) {
+	if err := sp.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := newJournalTestDir(t)
+	os.Chmod(dir, 0711)
+	os.Mkdir(filepath.Join(dir, "work"), perm)
+
+	filePath := filepath.Join(dir, "sandbox.sh")
+	ioutil.WriteFile(filePath, []byte(sandboxHandlerBody), 0755)
+
+	sh, err := newShellHandler(filePath, &HandlerConfig{WormTimeout: 5, WorkingDir: filepath.Join(dir, "work"), Sandbox: sp})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	dd := newDeliveryDispatcher(sh, nil, nil, &HandlerConfig{})
+	d := &Delivery{ID: "sandboxed", Source: "github"}
+	if err := dd.process(d, `{}`); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(d.Results[0].Stderr, "\n")
+	out := &sandboxHandlerOutput{}
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), out); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unexpected handler stderr %q: %v", d.Results[0].Stderr, err)
+	}
+
+	return dir, d, out
+}
+
+func TestSandboxEnvironAllowlist(t *testing.T) {
+	os.Setenv("SANDBOX_TEST_KEEP", "kept")
+	os.Setenv("SANDBOX_TEST_ALSO", "kept")
+	os.Setenv("HOOKWORM_BASIC_AUTH", "secret")
+	defer os.Setenv("SANDBOX_TEST_KEEP", "")
+	defer os.Setenv("SANDBOX_TEST_ALSO", "")
+	defer os.Setenv("HOOKWORM_BASIC_AUTH", "")
+
+	sp := &SandboxProfile{Env: []string{"PATH", "SANDBOX_TEST_*"}}
+	env := strings.Join(sp.environ(), "\n")
+
+	if !strings.Contains(env, "SANDBOX_TEST_KEEP=kept") || !strings.Contains(env, "SANDBOX_TEST_ALSO=kept") ||
+		!strings.Contains(env, "PATH=") {
+		t.Errorf("expected allowlisted variables to be passed: %q", env)
+	}
+
+	if strings.Contains(env, "HOOKWORM_BASIC_AUTH") {
+		t.Errorf("expected other variables to be withheld: %q", env)
+	}
+}
+
+func TestSandboxProfileMergeAndResolve(t *testing.T) {
+	global := &SandboxProfile{User: "54321", Env: []string{"PATH"}}
+	if err := global.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	override := &SandboxProfile{Group: "4242", Env: []string{"TZ"}}
+	if err := override.resolve(); err != nil {
+		t.Fatal(err)
+	}
+
+	merged := global.merge(override)
+	if merged.uid != 54321 || merged.gid != 4242 || strings.Join(merged.Env, ",") != "TZ" {
+		t.Errorf("unexpected merged profile %+v", merged)
+	}
+
+	if (*SandboxProfile)(nil).merge(nil) != nil {
+		t.Errorf("expected no profile when none is given")
+	}
+
+	bad := &SandboxProfile{Namespaces: []string{"time"}}
+	if err := bad.resolve(); err == nil || !strings.Contains(err.Error(), `unknown sandbox namespace "time"`) {
+		t.Errorf("expected unknown namespace error, got %v", err)
+	}
+}
+
+func TestSandboxedHandlerPrivateDir(t *testing.T) {
+	os.Setenv("SANDBOX_TEST_KEEP", "kept")
+	os.Setenv("HOOKWORM_BASIC_AUTH", "secret")
+	defer os.Setenv("SANDBOX_TEST_KEEP", "")
+	defer os.Setenv("HOOKWORM_BASIC_AUTH", "")
+
+	dir, d, out := runSandboxedHandler(&SandboxProfile{Env: []string{"PATH", "SANDBOX_TEST_KEEP"}}, 0750, t)
+	defer os.RemoveAll(dir)
+
+	if out.BasicAuth != "" || out.Keep != "kept" {
+		t.Errorf("expected only allowlisted variables to be passed: %+v", out)
+	}
+
+	deliveryDir := filepath.Join(dir, "work", sandboxDirName, "deliveries", "sandboxed-")
+	if !strings.HasPrefix(out.TmpDir, deliveryDir) || out.Home != out.TmpDir || out.WorkingDir != out.TmpDir ||
+		out.Pwd != out.TmpDir {
+		t.Errorf("expected a private directory for the delivery: %+v", out)
+	}
+
+	if out.Scratch != "scratch" {
+		t.Errorf("expected the private directory to be writable: %+v", out)
+	}
+
+	if _, err := os.Stat(out.TmpDir); !os.IsNotExist(err) {
+		t.Errorf("expected the private directory to be removed after delivery %s, got %v", d.ID, err)
+	}
+}
+
+func TestSandboxDeliveryDirsAreUnique(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	sp := &SandboxProfile{root: filepath.Join(dir, sandboxDirName)}
+
+	first, _, err := sp.deliveryDir(&Delivery{ID: "abc/def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _, err := sp.deliveryDir(&Delivery{ID: "abc_def"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Errorf("expected deliveries whose IDs replace alike to get their own directories: %v", first)
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/codegangsta/martini"
 	"github.com/codegangsta/martini-contrib/auth"
@@ -17,23 +20,78 @@ import (
 type serverSetupContext struct {
 	addr                string
 	args                []string
+	async               bool
+	asyncQueueSize      uint64
+	asyncQueueString    string
+	asyncString         string
+	asyncWorkers        uint64
+	asyncWorkersString  string
 	basicAuth           string
+	bitbucketPath       string
+	bitbucketSecret     string
+	configureTimeout    uint64
+	configureTimeoutStr string
+	dataDir             string
 	debug               bool
 	debugString         string
 	env                 []string
 	envWormFlags        string
+	fanout              bool
+	fanoutMerge         string
+	fanoutString        string
 	fl                  *flag.FlagSet
 	githubPath          string
+	githubSecret        string
+	gitlabPath          string
+	gitlabSecret        string
+	handlers            handlerNameList
+	handlersString      string
+	interpreters        interpreterFlagMap
+	interpretersString  string
+	limits              ResourceLimits
+	limitsString        string
 	noop                bool
+	outputJSON          bool
+	outputJSONString    string
+	outputMax           uint64
+	outputMaxString     string
+	outputOnInvalid     string
 	pidFile             string
 	printRevision       bool
 	printVersion        bool
 	printVersionRevTags bool
+	retryBackoff        float64
+	retryBackoffString  string
+	retryDelay          float64
+	retryDelayString    string
+	retryJitter         float64
+	retryJitterString   string
+	retryMax            uint64
+	retryMaxString      string
+	sandbox             bool
+	sandboxEnv          string
+	sandboxGroup        string
+	sandboxNamespaces   string
+	sandboxString       string
+	sandboxUser         string
+	sources             sourceMap
+	stderrKeep          uint64
+	stderrKeepString    string
+	sourcesString       string
+	strict              bool
+	strictString        string
 	staticDir           string
 	travisPath          string
+	travisPubkey        string
+	workerHealth        uint64
+	workerHealthString  string
 	workingDir          string
 	wormDir             string
+	wormKillGrace       uint64
+	wormKillGraceString string
 	wormTimeout         uint64
+	wormReload          uint64
+	wormReloadString    string
 	wormTimeoutString   string
 }
 
@@ -47,21 +105,64 @@ func ServerMain(c *serverSetupContext) int {
 	var err error
 	if c == nil {
 		c = &serverSetupContext{
-			addr:              os.Getenv("HOOKWORM_ADDR"),
-			args:              os.Args[1:],
-			basicAuth:         os.Getenv("HOOKWORM_BASIC_AUTH"),
-			debugString:       os.Getenv("HOOKWORM_DEBUG"),
-			env:               os.Environ(),
-			envWormFlags:      os.Getenv("HOOKWORM_WORM_FLAGS"),
-			fl:                flag.NewFlagSet("hookworm", flag.ExitOnError),
-			githubPath:        os.Getenv("HOOKWORM_GITHUB_PATH"),
-			pidFile:           os.Getenv("HOOKWORM_PID_FILE"),
-			staticDir:         os.Getenv("HOOKWORM_STATIC_DIR"),
-			travisPath:        os.Getenv("HOOKWORM_TRAVIS_PATH"),
-			workingDir:        os.Getenv("HOOKWORM_WORKING_DIR"),
-			wormDir:           os.Getenv("HOOKWORM_WORM_DIR"),
-			wormTimeout:       uint64(30),
-			wormTimeoutString: os.Getenv("HOOKWORM_HANDLER_TIMEOUT"),
+			addr:                os.Getenv("HOOKWORM_ADDR"),
+			args:                os.Args[1:],
+			asyncQueueSize:      uint64(100),
+			asyncQueueString:    os.Getenv("HOOKWORM_ASYNC_QUEUE_SIZE"),
+			asyncString:         os.Getenv("HOOKWORM_ASYNC"),
+			asyncWorkers:        uint64(4),
+			asyncWorkersString:  os.Getenv("HOOKWORM_ASYNC_WORKERS"),
+			basicAuth:           os.Getenv("HOOKWORM_BASIC_AUTH"),
+			bitbucketPath:       os.Getenv("HOOKWORM_BITBUCKET_PATH"),
+			bitbucketSecret:     os.Getenv("HOOKWORM_BITBUCKET_SECRET"),
+			configureTimeoutStr: os.Getenv("HOOKWORM_CONFIGURE_TIMEOUT"),
+			dataDir:             os.Getenv("HOOKWORM_DATA_DIR"),
+			debugString:         os.Getenv("HOOKWORM_DEBUG"),
+			env:                 os.Environ(),
+			envWormFlags:        os.Getenv("HOOKWORM_WORM_FLAGS"),
+			fanoutMerge:         os.Getenv("HOOKWORM_FANOUT_MERGE"),
+			fanoutString:        os.Getenv("HOOKWORM_FANOUT"),
+			fl:                  flag.NewFlagSet("hookworm", flag.ExitOnError),
+			githubPath:          os.Getenv("HOOKWORM_GITHUB_PATH"),
+			githubSecret:        os.Getenv("HOOKWORM_GITHUB_SECRET"),
+			gitlabPath:          os.Getenv("HOOKWORM_GITLAB_PATH"),
+			gitlabSecret:        os.Getenv("HOOKWORM_GITLAB_SECRET"),
+			handlersString:      os.Getenv("HOOKWORM_HANDLERS"),
+			interpretersString:  os.Getenv("HOOKWORM_INTERPRETERS"),
+			limitsString:        os.Getenv("HOOKWORM_LIMITS"),
+			pidFile:             os.Getenv("HOOKWORM_PID_FILE"),
+			retryBackoff:        float64(2),
+			retryBackoffString:  os.Getenv("HOOKWORM_RETRY_BACKOFF"),
+			retryDelay:          float64(1),
+			retryDelayString:    os.Getenv("HOOKWORM_RETRY_DELAY"),
+			retryJitterString:   os.Getenv("HOOKWORM_RETRY_JITTER"),
+			outputJSONString:    os.Getenv("HOOKWORM_OUTPUT_JSON"),
+			outputMax:           uint64(25 << 20),
+			outputMaxString:     os.Getenv("HOOKWORM_OUTPUT_MAX"),
+			outputOnInvalid:     os.Getenv("HOOKWORM_OUTPUT_ON_INVALID"),
+			retryMax:            uint64(1),
+			retryMaxString:      os.Getenv("HOOKWORM_RETRY_MAX"),
+			sandboxEnv:          os.Getenv("HOOKWORM_SANDBOX_ENV"),
+			sandboxGroup:        os.Getenv("HOOKWORM_SANDBOX_GROUP"),
+			sandboxNamespaces:   os.Getenv("HOOKWORM_SANDBOX_NAMESPACES"),
+			sandboxString:       os.Getenv("HOOKWORM_SANDBOX"),
+			sandboxUser:         os.Getenv("HOOKWORM_SANDBOX_USER"),
+			sourcesString:       os.Getenv("HOOKWORM_SOURCES"),
+			staticDir:           os.Getenv("HOOKWORM_STATIC_DIR"),
+			stderrKeepString:    os.Getenv("HOOKWORM_STDERR_KEEP"),
+			strictString:        os.Getenv("HOOKWORM_STRICT"),
+			travisPath:          os.Getenv("HOOKWORM_TRAVIS_PATH"),
+			travisPubkey:        os.Getenv("HOOKWORM_TRAVIS_PUBKEY"),
+			workerHealth:        uint64(30),
+			workerHealthString:  os.Getenv("HOOKWORM_WORKER_HEALTH"),
+			workingDir:          os.Getenv("HOOKWORM_WORKING_DIR"),
+			wormDir:             os.Getenv("HOOKWORM_WORM_DIR"),
+			wormReload:          uint64(5),
+			wormKillGrace:       uint64(5),
+			wormKillGraceString: os.Getenv("HOOKWORM_KILL_GRACE"),
+			wormReloadString:    os.Getenv("HOOKWORM_WORM_RELOAD"),
+			wormTimeout:         uint64(30),
+			wormTimeoutString:   os.Getenv("HOOKWORM_HANDLER_TIMEOUT"),
 		}
 	}
 
@@ -92,6 +193,22 @@ func ServerMain(c *serverSetupContext) int {
 
 	logger.Println("Starting", progVersion())
 
+	if len(c.limits) > 0 && !resourceLimitsSupported {
+		logger.Printf("ERROR: resource limits (%v) are only supported on linux\n", c.limits)
+		return 1
+	}
+
+	if len(c.limits) > 0 && !limitShimEnabled {
+		logger.Printf("ERROR: resource limits (%v) require an executable that runs %s\n", c.limits, LimitShimCommand)
+		return 1
+	}
+
+	sandbox, err := c.sandboxProfile()
+	if err != nil {
+		logger.Printf("ERROR: %v\n", err)
+		return 1
+	}
+
 	wormFlags := newWormFlagMap()
 	for i := 0; i < c.fl.NArg(); i++ {
 		wormFlags.Set(c.fl.Arg(i))
@@ -123,6 +240,10 @@ func ServerMain(c *serverSetupContext) int {
 
 	defer os.RemoveAll(c.workingDir)
 
+	if c.dataDir != "" && strings.HasPrefix(filepath.Clean(c.dataDir)+"/", filepath.Clean(c.workingDir)+"/") {
+		logger.Printf("WARNING: data directory %v is within the working directory and will not survive a restart\n", c.dataDir)
+	}
+
 	staticDir, err := getStaticDir(c.staticDir)
 	if err != nil {
 		logger.Printf("ERROR: %v\n", err)
@@ -136,26 +257,65 @@ func ServerMain(c *serverSetupContext) int {
 	}
 
 	cfg := &HandlerConfig{
-		Debug:         c.debug,
-		GithubPath:    c.githubPath,
+		Async:            c.async,
+		AsyncQueueSize:   int(c.asyncQueueSize),
+		AsyncWorkers:     int(c.asyncWorkers),
+		BitbucketPath:    c.bitbucketPath,
+		BitbucketSecret:  c.bitbucketSecret,
+		ConfigureTimeout: int(c.configureTimeout),
+		DataDir:          c.dataDir,
+		Debug:            c.debug,
+		Fanout:           c.fanout,
+		FanoutMerge:      c.fanoutMerge,
+		GithubPath:       c.githubPath,
+		GithubSecret:     c.githubSecret,
+		GitlabPath:       c.gitlabPath,
+		GitlabSecret:     c.gitlabSecret,
+		Handlers:         []string(c.handlers),
+		Interpreters:     map[string]string(c.interpreters),
+		Limits:           c.limits,
+		Output: &OutputPolicy{
+			MaxSize:   int(c.outputMax),
+			JSON:      &c.outputJSON,
+			OnInvalid: c.outputOnInvalid,
+		},
+		Retry: &RetryPolicy{
+			MaxAttempts:  int(c.retryMax),
+			InitialDelay: c.retryDelay,
+			Backoff:      c.retryBackoff,
+			Jitter:       c.retryJitter,
+		},
+		Sandbox:       sandbox,
 		ServerAddress: c.addr,
 		ServerPidFile: c.pidFile,
+		Sources:       map[string]string(c.sources),
 		StaticDir:     c.staticDir,
+		StderrKeep:    int(c.stderrKeep),
+		Strict:        c.strict,
 		TravisPath:    c.travisPath,
+		TravisPubkey:  c.travisPubkey,
+		WorkerHealth:  int(c.workerHealth),
 		WorkingDir:    c.workingDir,
 		WormDir:       c.wormDir,
+		WormKillGrace: int(c.wormKillGrace),
+		WormReload:    int(c.wormReload),
 		WormTimeout:   int(c.wormTimeout),
 		WormFlags:     wormFlags,
 		Version:       progVersion(),
 	}
 
+	if err := cfg.Output.validate(); err != nil {
+		logger.Printf("ERROR: %v\n", err)
+		return 1
+	}
+
 	logger.Debugf("Using handler config: %+v\n", cfg)
 
 	if err := os.Chdir(cfg.WorkingDir); err != nil {
 		logger.Fatalf("Failed to move into working directory %v\n", cfg.WorkingDir)
 	}
 
-	server, err := NewServer(c.basicAuth, cfg)
+	server, pipeline, err := newServer(c.basicAuth, cfg)
 
 	if err != nil {
 		logger.Fatal(err)
@@ -179,6 +339,8 @@ func ServerMain(c *serverSetupContext) int {
 		return 0
 	}
 
+	go pipeline.reloadOnSignal(syscall.SIGHUP)
+
 	logger.Fatal(http.ListenAndServe(cfg.ServerAddress, server))
 	return 0 // <-- never reached, but necessary to appease compiler
 }
@@ -196,6 +358,141 @@ func serverSetup(c *serverSetupContext) {
 		}
 	}
 
+	if len(c.wormKillGraceString) > 0 {
+		c.wormKillGrace, err = strconv.ParseUint(c.wormKillGraceString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid kill grace string given: %q %v", c.wormKillGraceString, err)
+		}
+	}
+
+	if len(c.wormReloadString) > 0 {
+		c.wormReload, err = strconv.ParseUint(c.wormReloadString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid worm reload string given: %q %v", c.wormReloadString, err)
+		}
+	}
+
+	if len(c.stderrKeepString) > 0 {
+		c.stderrKeep, err = strconv.ParseUint(c.stderrKeepString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid stderr keep string given: %q %v", c.stderrKeepString, err)
+		}
+	}
+
+	if len(c.workerHealthString) > 0 {
+		c.workerHealth, err = strconv.ParseUint(c.workerHealthString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid worker health string given: %q %v", c.workerHealthString, err)
+		}
+	}
+
+	if len(c.asyncString) > 0 {
+		c.async, err = strconv.ParseBool(c.asyncString)
+		if err != nil {
+			logger.Fatalf("Invalid async string given: %q %v", c.asyncString, err)
+		}
+	}
+
+	if len(c.asyncWorkersString) > 0 {
+		c.asyncWorkers, err = strconv.ParseUint(c.asyncWorkersString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid async workers string given: %q %v", c.asyncWorkersString, err)
+		}
+	}
+
+	if len(c.asyncQueueString) > 0 {
+		c.asyncQueueSize, err = strconv.ParseUint(c.asyncQueueString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid async queue size string given: %q %v", c.asyncQueueString, err)
+		}
+	}
+
+	if len(c.retryMaxString) > 0 {
+		c.retryMax, err = strconv.ParseUint(c.retryMaxString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid retry max string given: %q %v", c.retryMaxString, err)
+		}
+	}
+
+	if len(c.retryDelayString) > 0 {
+		c.retryDelay, err = strconv.ParseFloat(c.retryDelayString, 64)
+		if err != nil {
+			logger.Fatalf("Invalid retry delay string given: %q %v", c.retryDelayString, err)
+		}
+	}
+
+	if len(c.retryBackoffString) > 0 {
+		c.retryBackoff, err = strconv.ParseFloat(c.retryBackoffString, 64)
+		if err != nil {
+			logger.Fatalf("Invalid retry backoff string given: %q %v", c.retryBackoffString, err)
+		}
+	}
+
+	if len(c.configureTimeoutStr) > 0 {
+		c.configureTimeout, err = strconv.ParseUint(c.configureTimeoutStr, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid configure timeout string given: %q %v", c.configureTimeoutStr, err)
+		}
+	}
+
+	if len(c.strictString) > 0 {
+		c.strict, err = strconv.ParseBool(c.strictString)
+		if err != nil {
+			logger.Fatalf("Invalid strict string given: %q %v", c.strictString, err)
+		}
+	}
+
+	if len(c.retryJitterString) > 0 {
+		c.retryJitter, err = strconv.ParseFloat(c.retryJitterString, 64)
+		if err != nil {
+			logger.Fatalf("Invalid retry jitter string given: %q %v", c.retryJitterString, err)
+		}
+	}
+
+	if len(c.fanoutString) > 0 {
+		c.fanout, err = strconv.ParseBool(c.fanoutString)
+		if err != nil {
+			logger.Fatalf("Invalid fanout string given: %q %v", c.fanoutString, err)
+		}
+	}
+
+	if len(c.outputMaxString) > 0 {
+		c.outputMax, err = strconv.ParseUint(c.outputMaxString, 10, 64)
+		if err != nil {
+			logger.Fatalf("Invalid output max string given: %q %v", c.outputMaxString, err)
+		}
+	}
+
+	if len(c.outputJSONString) > 0 {
+		c.outputJSON, err = strconv.ParseBool(c.outputJSONString)
+		if err != nil {
+			logger.Fatalf("Invalid output json string given: %q %v", c.outputJSONString, err)
+		}
+	}
+
+	if len(c.sandboxString) > 0 {
+		c.sandbox, err = strconv.ParseBool(c.sandboxString)
+		if err != nil {
+			logger.Fatalf("Invalid sandbox string given: %q %v", c.sandboxString, err)
+		}
+	}
+
+	if c.outputOnInvalid == "" {
+		c.outputOnInvalid = outputFail
+	}
+
+	if c.outputOnInvalid != outputFail && c.outputOnInvalid != outputInput {
+		logger.Fatalf("Invalid output on invalid given: %q", c.outputOnInvalid)
+	}
+
+	if c.fanoutMerge == "" {
+		c.fanoutMerge = mergeFirst
+	}
+
+	if c.fanoutMerge != mergeFirst && c.fanoutMerge != mergeJSON {
+		logger.Fatalf("Invalid fanout merge given: %q", c.fanoutMerge)
+	}
+
 	if len(c.debugString) > 0 {
 		c.debug, err = strconv.ParseBool(c.debugString)
 		if err != nil {
@@ -203,10 +500,54 @@ func serverSetup(c *serverSetupContext) {
 		}
 	}
 
+	if c.sources == nil {
+		c.sources = sourceMap{}
+	}
+
+	if len(c.sourcesString) > 0 {
+		if err = c.sources.Set(c.sourcesString); err != nil {
+			logger.Fatalf("Invalid sources string given: %q %v", c.sourcesString, err)
+		}
+	}
+
+	if len(c.handlersString) > 0 {
+		if err = c.handlers.Set(c.handlersString); err != nil {
+			logger.Fatalf("Invalid handlers string given: %q %v", c.handlersString, err)
+		}
+	}
+
+	if c.interpreters == nil {
+		c.interpreters = interpreterFlagMap{}
+	}
+
+	if len(c.interpretersString) > 0 {
+		if err = c.interpreters.Set(c.interpretersString); err != nil {
+			logger.Fatalf("Invalid interpreters string given: %q %v", c.interpretersString, err)
+		}
+	}
+
+	if c.limits == nil {
+		c.limits = ResourceLimits{}
+	}
+
+	if len(c.limitsString) > 0 {
+		if err = c.limits.Set(c.limitsString); err != nil {
+			logger.Fatalf("Invalid limits string given: %q %v", c.limitsString, err)
+		}
+	}
+
+	if c.bitbucketPath == "" {
+		c.bitbucketPath = "/bitbucket"
+	}
+
 	if c.githubPath == "" {
 		c.githubPath = "/github"
 	}
 
+	if c.gitlabPath == "" {
+		c.gitlabPath = "/gitlab"
+	}
+
 	if c.travisPath == "" {
 		c.travisPath = "/travis"
 	}
@@ -221,24 +562,132 @@ func serverSetup(c *serverSetupContext) {
 
 	fl.StringVar(&c.addr, "a", c.addr, "Server address [HOOKWORM_ADDR]")
 	fl.Uint64Var(&c.wormTimeout, "T", c.wormTimeout, "Timeout for handler executables (in seconds) [HOOKWORM_HANDLER_TIMEOUT]")
+	fl.Uint64Var(&c.wormKillGrace, "kill.grace", c.wormKillGrace, "Time allowed for timed out handlers to exit after SIGTERM before SIGKILL (in seconds) [HOOKWORM_KILL_GRACE]")
+	fl.Uint64Var(&c.configureTimeout, "configure.timeout", c.configureTimeout, "Timeout for each handler's configure phase at startup and reload (in seconds, default -T) [HOOKWORM_CONFIGURE_TIMEOUT]")
+	fl.BoolVar(&c.strict, "strict", c.strict, "Abort startup if any handler fails to configure [HOOKWORM_STRICT]")
+	fl.Uint64Var(&c.stderrKeep, "stderr.keep", c.stderrKeep, "Number of per-delivery handler stderr logs kept under the working directory (0 to disable) [HOOKWORM_STDERR_KEEP]")
 	fl.StringVar(&c.workingDir, "D", c.workingDir, "Working directory (scratch pad) [HOOKWORM_WORKING_DIR]")
 	fl.StringVar(&c.wormDir, "W", c.wormDir, "Worm directory that contains handler executables [HOOKWORM_WORM_DIR]")
+	fl.Uint64Var(&c.wormReload, "worm.reload", c.wormReload, "Interval at which the worm directory is checked for changes (in seconds, 0 to disable) [HOOKWORM_WORM_RELOAD]")
+	fl.Uint64Var(&c.workerHealth, "worker.health", c.workerHealth, "Interval at which persistent handlers are health checked (in seconds, 0 to disable) [HOOKWORM_WORKER_HEALTH]")
 	fl.StringVar(&c.staticDir, "S", c.staticDir, "Public static directory (default $PWD/public) [HOOKWORM_STATIC_DIR]")
+	fl.StringVar(&c.dataDir, "data.dir", c.dataDir, "Data directory for the delivery journal (only written if flag given) [HOOKWORM_DATA_DIR]")
+	fl.Var(&c.handlers, "handler", "Registered native handler to add to the end of the pipeline, may be repeated [HOOKWORM_HANDLERS]")
+	fl.Var(c.limits, "limit", "Resource limit for handler processes as name=value (as, cpu, nproc, nofile or core), may be repeated [HOOKWORM_LIMITS]")
+	fl.Var(c.interpreters, "interpreter", "Interpreter for handler files as ext=command, may be repeated [HOOKWORM_INTERPRETERS]")
 	fl.StringVar(&c.pidFile, "P", c.pidFile, "PID file (only written if flag given) [HOOKWORM_PID_FILE]")
 	fl.BoolVar(&c.debug, "d", c.debug, "Show debug output [HOOKWORM_DEBUG]")
 
+	fl.BoolVar(&c.async, "async", c.async, "Respond 202 immediately and handle payloads in the background [HOOKWORM_ASYNC]")
+	fl.Uint64Var(&c.asyncWorkers, "async.workers", c.asyncWorkers, "Number of background workers in async mode [HOOKWORM_ASYNC_WORKERS]")
+	fl.Uint64Var(&c.asyncQueueSize, "async.queue", c.asyncQueueSize, "Number of payloads that may wait for a worker in async mode [HOOKWORM_ASYNC_QUEUE_SIZE]")
+
+	fl.Uint64Var(&c.retryMax, "retry.max", c.retryMax, "Maximum attempts per handler for transient failures (exit 75 or timeout) [HOOKWORM_RETRY_MAX]")
+	fl.Float64Var(&c.retryDelay, "retry.delay", c.retryDelay, "Delay before the first retry (in seconds) [HOOKWORM_RETRY_DELAY]")
+	fl.Float64Var(&c.retryBackoff, "retry.backoff", c.retryBackoff, "Factor by which the retry delay grows after each attempt [HOOKWORM_RETRY_BACKOFF]")
+	fl.Float64Var(&c.retryJitter, "retry.jitter", c.retryJitter, "Fraction by which each retry delay is randomly varied [HOOKWORM_RETRY_JITTER]")
+
+	fl.Uint64Var(&c.outputMax, "output.max", c.outputMax, "Maximum size of the payload each handler passes along (in bytes, 0 for unlimited) [HOOKWORM_OUTPUT_MAX]")
+	fl.BoolVar(&c.outputJSON, "output.json", c.outputJSON, "Require the payload each handler passes along to be valid JSON [HOOKWORM_OUTPUT_JSON]")
+	fl.StringVar(&c.outputOnInvalid, "output.on-invalid", c.outputOnInvalid, "What to do when a handler's output is invalid (fail, or input to pass its input along) [HOOKWORM_OUTPUT_ON_INVALID]")
+
+	fl.BoolVar(&c.sandbox, "sandbox", c.sandbox, "Run handlers with an allowlisted environment and a private directory per delivery [HOOKWORM_SANDBOX]")
+	fl.StringVar(&c.sandboxUser, "sandbox.user", c.sandboxUser, "User sandboxed handlers run as (implies -sandbox) [HOOKWORM_SANDBOX_USER]")
+	fl.StringVar(&c.sandboxGroup, "sandbox.group", c.sandboxGroup, "Group sandboxed handlers run as (default the user's group) [HOOKWORM_SANDBOX_GROUP]")
+	fl.StringVar(&c.sandboxEnv, "sandbox.env", c.sandboxEnv, "Comma-separated environment variables passed to sandboxed handlers (default PATH,LANG,LC_*,TZ) [HOOKWORM_SANDBOX_ENV]")
+	fl.StringVar(&c.sandboxNamespaces, "sandbox.namespaces", c.sandboxNamespaces, "Comma-separated Linux namespaces for sandboxed handlers (net, ipc, uts, mount, pid, user; implies -sandbox) [HOOKWORM_SANDBOX_NAMESPACES]")
+
+	fl.BoolVar(&c.fanout, "fanout", c.fanout, "Run handlers sharing a numeric prefix concurrently [HOOKWORM_FANOUT]")
+	fl.StringVar(&c.fanoutMerge, "fanout.merge", c.fanoutMerge, "How concurrent handler outputs are merged (first or json) [HOOKWORM_FANOUT_MERGE]")
+
+	fl.StringVar(&c.bitbucketPath, "bitbucket.path", c.bitbucketPath, "Path to handle Bitbucket payloads [HOOKWORM_BITBUCKET_PATH]")
+	fl.StringVar(&c.bitbucketSecret, "bitbucket.secret", c.bitbucketSecret, "Secret used to verify Bitbucket payload signatures [HOOKWORM_BITBUCKET_SECRET]")
 	fl.StringVar(&c.githubPath, "github.path", c.githubPath, "Path to handle Github payloads [HOOKWORM_GITHUB_PATH]")
+	fl.StringVar(&c.githubSecret, "github.secret", c.githubSecret, "Secret used to verify Github payload signatures [HOOKWORM_GITHUB_SECRET]")
+	fl.StringVar(&c.gitlabPath, "gitlab.path", c.gitlabPath, "Path to handle Gitlab payloads [HOOKWORM_GITLAB_PATH]")
+	fl.StringVar(&c.gitlabSecret, "gitlab.secret", c.gitlabSecret, "Secret token expected in Gitlab payload headers [HOOKWORM_GITLAB_SECRET]")
 	fl.StringVar(&c.travisPath, "travis.path", c.travisPath, "Path to handle Travis payloads [HOOKWORM_TRAVIS_PATH]")
+	fl.StringVar(&c.travisPubkey, "travis.pubkey", c.travisPubkey, "PEM file with public key used to verify Travis payload signatures [HOOKWORM_TRAVIS_PUBKEY]")
+	fl.Var(c.sources, "source", "Extra webhook source as name=/path, may be repeated [HOOKWORM_SOURCES]")
 	fl.StringVar(&c.basicAuth, "b", c.basicAuth, "Basic auth username:password [HOOKWORM_BASIC_AUTH]")
 }
 
 // NewServer builds a martini.ClassicMartini instance given a HandlerConfig
 func NewServer(basicAuthStr string, cfg *HandlerConfig) (*martini.ClassicMartini, error) {
-	pipeline, err := NewHandlerPipeline(cfg)
+	m, _, err := newServer(basicAuthStr, cfg)
+	return m, err
+}
+
+func newServer(basicAuthStr string, cfg *HandlerConfig) (*martini.ClassicMartini, *reloadablePipeline, error) {
+	travisKey, err := loadTravisPublicKey(cfg.TravisPubkey)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	builtinSourcePaths := map[string]bool{
+		cfg.BitbucketPath: true,
+		cfg.GithubPath:    true,
+		cfg.GitlabPath:    true,
+		cfg.TravisPath:    true,
+	}
+
+	for name, sourcePath := range cfg.Sources {
+		if builtinSourcePaths[sourcePath] {
+			return nil, nil, fmt.Errorf("source %q path %q conflicts with a builtin source", name, sourcePath)
+		}
+	}
+
+	var (
+		journal     *deliveryJournal
+		pending     []*journalEntry
+		deadLetters *deadLetterStore
+		stderrLogs  *stderrLogStore
+	)
+
+	if cfg.DataDir != "" {
+		deadLetters, err = openDeadLetterStore(cfg.DataDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Debugf("Using dead letter directory %v\n", deadLetters.dir)
+	}
+
+	if cfg.StderrKeep > 0 && cfg.WorkingDir != "" {
+		stderrLogs, err = openStderrLogStore(cfg.WorkingDir, cfg.StderrKeep)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Debugf("Using stderr log directory %v\n", stderrLogs.dir)
+	}
+
+	// Everything that can refuse to start the server is checked above, so
+	// that the journal is only held open, and the watcher and resumed
+	// deliveries only started, once startup is going ahead.
+	if cfg.DataDir != "" {
+		journal, pending, err = openDeliveryJournal(cfg.DataDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		logger.Debugf("Using delivery journal %v\n", journal.path)
+	}
+
+	pipeline, err := newReloadablePipeline(cfg)
+	if err != nil {
+		if journal != nil {
+			journal.Close()
+		}
+		return nil, nil, err
+	}
+
+	if cfg.WormDir != "" && cfg.WormReload > 0 {
+		go pipeline.watch(time.Duration(cfg.WormReload) * time.Second)
+	}
+
+	dispatcher := newDeliveryDispatcher(pipeline, journal, deadLetters, cfg)
+	dispatcher.stderrLogs = stderrLogs
+
+	go dispatcher.resume(pending)
+
 	m := martini.Classic()
 
 	m.Use(martini.Static(cfg.StaticDir))
@@ -255,14 +704,46 @@ func NewServer(basicAuthStr string, cfg *HandlerConfig) (*martini.ClassicMartini
 	m.Map(logger)
 
 	m.MapTo(pipeline, (*Handler)(nil))
+	m.Map(dispatcher)
 	m.Map(cfg)
 
-	m.Post(cfg.GithubPath, handleGithubPayload)
-	m.Post(cfg.TravisPath, handleTravisPayload)
+	if cfg.BitbucketSecret != "" {
+		logger.Debugf("Adding bitbucket signature verification\n")
+	}
+
+	if cfg.GithubSecret != "" {
+		logger.Debugf("Adding github signature verification\n")
+	}
+
+	if cfg.GitlabSecret != "" {
+		logger.Debugf("Adding gitlab token verification\n")
+	}
+
+	if travisKey != nil {
+		logger.Debugf("Adding travis signature verification\n")
+	}
+
+	m.Post(cfg.BitbucketPath, bitbucketSignatureVerifier(cfg.BitbucketSecret), handleBitbucketPayload)
+	m.Post(cfg.GithubPath, githubSignatureVerifier(cfg.GithubSecret), handleGithubPayload)
+	m.Post(cfg.GitlabPath, gitlabTokenVerifier(cfg.GitlabSecret), handleGitlabPayload)
+	m.Post(cfg.TravisPath, travisSignatureVerifier(travisKey), handleTravisPayload)
+
+	for name, sourcePath := range cfg.Sources {
+		logger.Debugf("Adding %s source at %v\n", name, sourcePath)
+		m.Post(sourcePath, sourcePayloadHandler(name))
+	}
+
 	m.Get("/blank", func() int {
 		return http.StatusNoContent
 	})
 	m.Get("/config", handleConfig)
+	m.Get("/handlers", handleHandlers)
+	m.Get("/deliveries", handleDeliveries)
+	m.Get("/deliveries/:id", handleDelivery)
+	m.Get("/dead-letters", handleDeadLetters)
+	m.Get("/dead-letters/:id", handleDeadLetter)
+	m.Post("/dead-letters/:id/requeue", handleRequeueDeadLetter)
+	m.Delete("/dead-letters/:id", handleDiscardDeadLetter)
 	m.Get("/favicon.ico", func() (int, string) {
 		return http.StatusOK, string(hookwormFaviconBytes)
 	})
@@ -273,5 +754,35 @@ func NewServer(basicAuthStr string, cfg *HandlerConfig) (*martini.ClassicMartini
 		m.Get("/debug/test", handleTestPage)
 	}
 
-	return m, nil
+	return m, pipeline, nil
+}
+
+// sandboxProfile returns the sandbox profile given by the sandbox flags, if
+// sandboxing is enabled
+func (c *serverSetupContext) sandboxProfile() (*SandboxProfile, error) {
+	if !c.sandbox && c.sandboxUser == "" && c.sandboxGroup == "" && c.sandboxNamespaces == "" {
+		return nil, nil
+	}
+
+	sp := &SandboxProfile{
+		User:       c.sandboxUser,
+		Group:      c.sandboxGroup,
+		Env:        splitList(c.sandboxEnv),
+		Namespaces: splitList(c.sandboxNamespaces),
+	}
+
+	if err := sp.resolve(); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
@@ -1,6 +1,7 @@
 package hookworm
 
 import (
+	"crypto/sha256"
 	"flag"
 	"fmt"
 	"io"
@@ -19,9 +20,12 @@ import (
 
 var (
 	serverTestConfig = &HandlerConfig{
-		Debug:      true,
-		GithubPath: "/github-test",
-		TravisPath: "/travis-test",
+		BitbucketPath: "/bitbucket-test",
+		Debug:         true,
+		GithubPath:    "/github-test",
+		GitlabPath:    "/gitlab-test",
+		TravisPath:    "/travis-test",
+		Sources:       map[string]string{"deploys": "/deploys-test"},
 	}
 	serverTestContext = &serverSetupContext{
 		args:  []string{"-a", ":9989"},
@@ -68,6 +72,45 @@ elif sys.argv[1:3] == ['handle', 'travis']:
     sys.exit(0)
 else:
     sys.exit(78)
+`,
+		"40-push-only.py": `#!/usr/bin/env python
+import json
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    json.dump({'events': ['push']}, sys.stdout)
+    sys.exit(0)
+elif os.environ.get('HOOKWORM_EVENT', 'push') not in ('', 'push'):
+    sys.exit(1)
+sys.stdout.write(sys.stdin.read())
+sys.exit(0)
+`,
+		"50-gitlab-only.py": `#!/usr/bin/env python
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+elif sys.argv[1:3] == ['handle', 'gitlab']:
+    if sys.argv[3:] != [os.environ['HOOKWORM_EVENT']]:
+        sys.exit(1)
+    sys.exit(0)
+else:
+    sys.exit(78)
+`,
+		"60-bitbucket-only.py": `#!/usr/bin/env python
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+elif sys.argv[1:3] == ['handle', 'bitbucket']:
+    if sys.argv[3:] != [os.environ['HOOKWORM_EVENT']]:
+        sys.exit(1)
+    sys.exit(0)
+else:
+    sys.exit(78)
 `,
 		".hidden.py": `#!/usr/bin/env python
 import sys
@@ -77,7 +120,7 @@ sys.exit(1)
 	}
 )
 
-func init() {
+func setupServerTest() {
 	if os.Getenv("DEBUG") != "" {
 		logger.debug = true
 	}
@@ -115,6 +158,10 @@ func getPayload(kind, name string) string {
 	parts := []string{here, "sampledata"}
 	if kind == "github" {
 		parts = append(parts, "github-payloads")
+	} else if kind == "bitbucket" {
+		parts = append(parts, "bitbucket-payloads")
+	} else if kind == "gitlab" {
+		parts = append(parts, "gitlab-payloads")
 	} else if kind == "travis" {
 		parts = append(parts, "travis-payloads")
 	}
@@ -147,6 +194,10 @@ func setupServer() (*httptest.ResponseRecorder, *martini.ClassicMartini) {
 }
 
 func getResponse(verb, path, ctype string, body io.Reader) *httptest.ResponseRecorder {
+	return getResponseWithHeaders(verb, path, ctype, body, nil)
+}
+
+func getResponseWithHeaders(verb, path, ctype string, body io.Reader, headers map[string]string) *httptest.ResponseRecorder {
 	hr, m := setupServer()
 
 	req, err := http.NewRequest(verb, path, body)
@@ -158,6 +209,10 @@ func getResponse(verb, path, ctype string, body io.Reader) *httptest.ResponseRec
 		req.Header.Set("Content-Type", ctype)
 	}
 
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
 	m.ServeHTTP(hr, req)
 	return hr
 }
@@ -196,6 +251,153 @@ func TestServerRespondsToGithubForm(t *testing.T) {
 	}
 }
 
+func TestServerRespondsToGithubPushEvent(t *testing.T) {
+	resp := getResponseWithHeaders("POST", "/github-test", "application/json",
+		getPayloadJSONReader("github", "valid"),
+		map[string]string{"X-GitHub-Event": "push", "X-GitHub-Delivery": "push-1"})
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerSkipsHandlersForUndeclaredEvents(t *testing.T) {
+	resp := getResponseWithHeaders("POST", "/github-test", "application/json",
+		getPayloadJSONReader("github", "pull_request"),
+		map[string]string{"X-GitHub-Event": "pull_request", "X-GitHub-Delivery": "pr-1"})
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func getGitlabResponse(secret, token, event, name string) *httptest.ResponseRecorder {
+	cfg := *serverTestConfig
+	cfg.GitlabSecret = secret
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", "/gitlab-test", getPayloadJSONReader("gitlab", name))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Gitlab-Event", event)
+	if token != "" {
+		req.Header.Set("X-Gitlab-Token", token)
+	}
+
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+	return hr
+}
+
+func TestServerRespondsToGitlabJSON(t *testing.T) {
+	for event, name := range map[string]string{
+		"Push Hook":          "push",
+		"Merge Request Hook": "merge_request",
+		"Pipeline Hook":      "pipeline",
+	} {
+		resp := getGitlabResponse("", "", event, name)
+		if resp.Code != 204 {
+			fmt.Println(resp.Body.String())
+			t.Errorf("%s: unexpected status %v", event, resp.Code)
+		}
+	}
+}
+
+func TestServerAcceptsGitlabPayloadWithToken(t *testing.T) {
+	resp := getGitlabResponse("t0k3n", "t0k3n", "Push Hook", "push")
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsGitlabPayloadWithoutToken(t *testing.T) {
+	resp := getGitlabResponse("t0k3n", "", "Push Hook", "push")
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsGitlabPayloadWithWrongToken(t *testing.T) {
+	resp := getGitlabResponse("t0k3n", "t0k3", "Push Hook", "push")
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func getBitbucketResponse(secret, signature, event, name string) *httptest.ResponseRecorder {
+	cfg := *serverTestConfig
+	cfg.BitbucketSecret = secret
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", "/bitbucket-test", getPayloadJSONReader("bitbucket", name))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Key", event)
+	req.Header.Set("X-Request-UUID", "b1tb0cket-"+name)
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+	return hr
+}
+
+func TestServerRespondsToBitbucketJSON(t *testing.T) {
+	for event, name := range map[string]string{
+		"repo:push":           "repo_push",
+		"pullrequest:created": "pullrequest_created",
+		"repo:refs_changed":   "server_refs_changed",
+	} {
+		resp := getBitbucketResponse("", "", event, name)
+		if resp.Code != 204 {
+			fmt.Println(resp.Body.String())
+			t.Errorf("%s: unexpected status %v", event, resp.Code)
+		}
+	}
+}
+
+func TestServerAcceptsSignedBitbucketPayload(t *testing.T) {
+	signature := githubSign(sha256.New, "sha256=", "b1tb0ck3t", getPayload("bitbucket", "repo_push"))
+	resp := getBitbucketResponse("b1tb0ck3t", signature, "repo:push", "repo_push")
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsUnsignedBitbucketPayload(t *testing.T) {
+	resp := getBitbucketResponse("b1tb0ck3t", "", "repo:push", "repo_push")
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsBadlySignedBitbucketPayload(t *testing.T) {
+	signature := githubSign(sha256.New, "sha256=", "nope", getPayload("bitbucket", "repo_push"))
+	resp := getBitbucketResponse("b1tb0ck3t", signature, "repo:push", "repo_push")
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
 func TestServerRespondsToTravisJSON(t *testing.T) {
 	resp := getResponse("POST", "/travis-test", "application/json",
 		getPayloadJSONReader("travis", "valid"))
@@ -214,6 +416,39 @@ func TestServerRespondsToTravisForm(t *testing.T) {
 	}
 }
 
+func TestServerRespondsToExtraSourceJSON(t *testing.T) {
+	resp := getResponse("POST", "/deploys-test", "application/json",
+		strings.NewReader(`{"environment":"production","status":"success"}`))
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestNewServerRejectsConflictingSourcePath(t *testing.T) {
+	cfg := *serverTestConfig
+	cfg.Sources = map[string]string{"hub": cfg.GithubPath}
+	if _, err := NewServer("", &cfg); err == nil {
+		t.Fail()
+	}
+}
+
+func TestNewServerOpensNothingWhenRejected(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	cfg := *serverTestConfig
+	cfg.DataDir = dir
+	cfg.Sources = map[string]string{"hub": cfg.GithubPath}
+	if _, err := NewServer("", &cfg); err == nil {
+		t.Fatal("expected the conflicting source path to be rejected")
+	}
+
+	if _, err := os.Stat(path.Join(dir, journalFileName)); !os.IsNotExist(err) {
+		t.Errorf("expected the journal not to be opened, got %v", err)
+	}
+}
+
 func TestServerMainDoesNotExplode(t *testing.T) {
 	if ServerMain(serverTestContext) != 0 {
 		t.Fail()
@@ -1,82 +1,407 @@
 package hookworm
 
 import (
-	"bytes"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
 )
 
+const (
+	stderrTailSize = 4096
+
+	// resultDrainTimeout is how long is left to read what remains of a
+	// result envelope once the handler has exited
+	resultDrainTimeout = 100 * time.Millisecond
+)
+
 type exitNoop struct{}
 
 func (e *exitNoop) Error() string {
 	return "exit noop 78"
 }
 
+type exitTempfail struct{}
+
+func (e *exitTempfail) Error() string {
+	return "exit tempfail 75"
+}
+
+// exitTimeout is a handler that ran past its timeout.  Killed is true if
+// it had to be sent SIGKILL because it was still running at the end of the
+// grace period that followed SIGTERM.
+type exitTimeout struct {
+	timeout int
+	killed  bool
+}
+
+func (e *exitTimeout) Error() string {
+	if e.killed {
+		return fmt.Sprintf("timed out after %ds (killed)", e.timeout)
+	}
+	return fmt.Sprintf("timed out after %ds", e.timeout)
+}
+
+// handlerError describes a handler command that failed, along with the tail
+// of what it wrote to standard error
+type handlerError struct {
+	Handler    string
+	ExitStatus int
+	TimedOut   bool
+	Limit      string
+	Stderr     string
+	Err        error
+}
+
+func (e *handlerError) Error() string {
+	return fmt.Sprintf("%s: %v", path.Base(e.Handler), e.Err)
+}
+
+func newHandlerError(handler string, stderr []byte, err error) *handlerError {
+	return &handlerError{
+		Handler:    handler,
+		ExitStatus: exitStatus(err),
+		TimedOut:   isTimeout(err),
+		Limit:      exceededLimit(err),
+		Stderr:     string(stderr),
+		Err:        err,
+	}
+}
+
+// exitStatus returns the exit status corresponding to a handler command
+// error, or -1 if the command never exited on its own
+func exitStatus(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *exitTempfail:
+		return 75
+	case *exitNoop:
+		return 78
+	case *workerStatusError:
+		return e.status
+	case *limitExceeded:
+		return exitStatus(e.err)
+	case *exec.ExitError:
+		return e.Sys().(syscall.WaitStatus).ExitStatus()
+	default:
+		return -1
+	}
+}
+
+func isTimeout(err error) bool {
+	_, ok := err.(*exitTimeout)
+	return ok
+}
+
+// exceededLimit returns the name of the resource limit the handler was
+// killed for hitting, if any
+func exceededLimit(err error) string {
+	if le, ok := err.(*limitExceeded); ok {
+		return le.limit
+	}
+	return ""
+}
+
+// tailBuffer is an io.Writer that keeps only the last max bytes written
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.buf = append(tb.buf, p...)
+	if len(tb.buf) > tb.max {
+		tb.buf = tb.buf[len(tb.buf)-tb.max:]
+	}
+	return len(p), nil
+}
+
 type shellCommand struct {
 	interpreter string
 	filePath    string
+	args        []string
+	env         []string
 	timeout     int
+	grace       int
+	limits      ResourceLimits
+	outputMax   int
+	sandbox     *SandboxProfile
 }
 
-func newShellCommand(interpreter, filePath string, timeout int) shellCommand {
+func newShellCommand(interpreter, filePath string, timeout, grace int) shellCommand {
 	return shellCommand{
 		interpreter: interpreter,
 		filePath:    filePath,
 		timeout:     timeout,
+		grace:       grace,
 	}
 }
 
-func (sc *shellCommand) configure(config string) ([]byte, error) {
-	return sc.runCmd(config, "configure")
-}
+// configure runs the command's configure phase, with its own timeout rather
+// than the handler timeout
+func (sc *shellCommand) configure(config string, timeout int) ([]byte, error) {
+	dir, env, err := sc.sandboxDir(nil)
+	if err != nil {
+		return nil, newHandlerError(sc.filePath, nil, err)
+	}
 
-func (sc *shellCommand) handleGithubPayload(payload string) ([]byte, error) {
-	return sc.runCmd(payload, "handle", "github")
+	stderr := newLineLogger(sc.filePath, nil)
+	defer stderr.flush()
+
+	cc := *sc
+	cc.timeout = timeout
+
+	output, err := cc.runCmd(config, dir, env, stderr, "configure")
+	if _, ok := err.(*exitNoop); ok {
+		// handlers with nothing to configure may answer with the no-op
+		// status, which succeeds without declaring anything
+		return nil, nil
+	}
+	if err != nil {
+		return output.out, newHandlerError(sc.filePath, output.stderr, err)
+	}
+	return output.out, nil
 }
 
-func (sc *shellCommand) handleTravisPayload(payload string) ([]byte, error) {
-	return sc.runCmd(payload, "handle", "travis")
+func (sc *shellCommand) handlePayload(delivery *Delivery, payload string) (*handlerOutput, error) {
+	dir, env, err := sc.sandboxDir(delivery)
+	if err != nil {
+		return &handlerOutput{}, err
+	}
+
+	stderr := newLineLogger(sc.filePath, delivery)
+	defer stderr.flush()
+
+	return sc.runCmd(payload, dir, append(deliveryEnv(delivery), env...), stderr, deliveryArgv(delivery)...)
 }
 
-func (sc *shellCommand) runCmd(stdin string, argv ...string) ([]byte, error) {
+// sandboxDir creates the private directory of a sandboxed handler, for the
+// delivery if any, returning it along with the variables that point the
+// handler at it
+func (sc *shellCommand) sandboxDir(delivery *Delivery) (string, []string, error) {
+	if sc.sandbox == nil {
+		return "", nil, nil
+	}
+
 	var (
-		cmd         *exec.Cmd
-		commandArgs []string
-		out         bytes.Buffer
+		dir string
+		env []string
+		err error
 	)
+	if delivery != nil {
+		dir, env, err = sc.sandbox.deliveryDir(delivery)
+	} else {
+		dir, env, err = sc.sandbox.handlerDir(sc.filePath)
+	}
 
-	if sc.filePath != "" {
-		commandArgs = append(commandArgs, sc.filePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create sandbox directory: %v", err)
 	}
+	return dir, env, nil
+}
+
+func deliveryArgv(delivery *Delivery) []string {
+	argv := []string{"handle", delivery.Source}
+	if delivery.Event != "" {
+		argv = append(argv, delivery.Event)
+	}
+	return argv
+}
 
+func deliveryEnv(delivery *Delivery) []string {
+	return []string{
+		"HOOKWORM_SOURCE=" + delivery.Source,
+		"HOOKWORM_EVENT=" + delivery.Event,
+		"HOOKWORM_DELIVERY=" + delivery.ID,
+		"HOOKWORM_SOURCE_DELIVERY=" + delivery.SourceID,
+		fmt.Sprintf("HOOKWORM_RESULT_FD=%d", resultFD),
+	}
+}
+
+// newCmd builds the command for the given positional arguments, run in the
+// given directory (if any, otherwise our own) with the given variables
+// added to the environment
+func (sc *shellCommand) newCmd(dir string, env []string, argv ...string) *exec.Cmd {
+	var commandArgs []string
+
+	filePath := sc.filePath
+	if dir != "" && filePath != "" {
+		// the path must still resolve from the other directory
+		if abs, err := filepath.Abs(filePath); err == nil {
+			filePath = abs
+		}
+	}
+
+	name := sc.interpreter
+	if name == "" {
+		// executed directly, so make sure the path isn't looked up in $PATH
+		name = filePath
+		if !strings.Contains(name, "/") {
+			name = "./" + name
+		}
+	} else if filePath != "" {
+		commandArgs = append(commandArgs, filePath)
+	}
+
+	commandArgs = append(commandArgs, sc.args...)
 	commandArgs = append(commandArgs, argv...)
 
-	cmd = exec.Command(sc.interpreter, commandArgs...)
+	cmd := exec.Command(name, commandArgs...)
+	cmd.Dir = dir
+	// run in a process group of its own, so that anything the handler
+	// starts can be signalled along with it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if sc.sandbox != nil {
+		cmd.Env = append(append(append([]string{}, sc.sandbox.environ()...), sc.env...), env...)
+		sc.sandbox.apply(cmd.SysProcAttr)
+	} else if env != nil || sc.env != nil {
+		cmd.Env = append(append(os.Environ(), sc.env...), env...)
+	}
+	return cmd
+}
+
+// runCmd runs the command in the directory, if any, returning its standard output, the tail of its
+// standard error (which is also written to stderrLog) and any result
+// envelope it wrote to resultFD
+func (sc *shellCommand) runCmd(stdin, dir string, env []string, stderrLog io.Writer, argv ...string) (*handlerOutput, error) {
+	var (
+		out    = &boundedBuffer{max: sc.outputMax}
+		stderr = &tailBuffer{max: stderrTailSize}
+		output = &handlerOutput{}
+	)
+
+	resultReader, resultWriter, err := os.Pipe()
+	if err != nil {
+		return output, err
+	}
+	defer resultReader.Close()
+
+	cmd := sc.newCmd(dir, env, argv...)
 	cmd.Stdin = strings.NewReader(stdin)
-	cmd.Stdout = &out
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = out
+	cmd.Stderr = io.MultiWriter(stderrLog, stderr)
+	cmd.ExtraFiles = []*os.File{resultWriter}
 
-	err := cmd.Start()
+	err = sc.start(cmd)
+	resultWriter.Close()
 	if err != nil {
-		return []byte(""), err
+		return output, err
+	}
+
+	result := make(chan []byte, 1)
+	go func() {
+		b, _ := readBounded(resultReader, sc.envelopeMax())
+		result <- b
+	}()
+
+	err = sc.wait(cmd)
+
+	// anything the handler left running in the background may still hold
+	// the result pipe open, so only what it has written by now is read
+	resultReader.SetReadDeadline(time.Now().Add(resultDrainTimeout))
+
+	output.out = out.Bytes()
+	output.stderr = stderr.buf
+
+	envelope, envErr := parseResultEnvelope(<-result)
+	if err == nil && envErr != nil {
+		err = envErr
+	}
+	output.envelope = envelope
+
+	return output, err
+}
+
+// envelopeMax is the most that is read of a result envelope, which is
+// allowed some room beyond the output max for everything but the payload
+func (sc *shellCommand) envelopeMax() int {
+	if sc.outputMax <= 0 {
+		return 0
 	}
+	return sc.outputMax + resultEnvelopeOverhead
+}
 
-	done := make(chan error)
+// start starts the command, with its resource limits, if any, in force
+// before it runs
+func (sc *shellCommand) start(cmd *exec.Cmd) error {
+	if len(sc.limits) > 0 {
+		if err := limitCmd(cmd, sc.limits); err != nil {
+			return err
+		}
+	}
+
+	return cmd.Start()
+}
+
+// wait waits for the command to exit, terminating its process group if it
+// runs past the timeout
+func (sc *shellCommand) wait(cmd *exec.Cmd) error {
+	if sc.timeout < 1 {
+		return sc.exitError(cmd, cmd.Wait())
+	}
+
+	done := make(chan error, 1)
 	go func() { done <- cmd.Wait() }()
 
 	select {
 	case <-time.After(time.Duration(sc.timeout) * time.Second):
-		err := cmd.Process.Kill()
-		<-done
-		return out.Bytes(), sc.errWrap(err)
+		logger.Printf("Timed out %v after %ds, terminating process group %d\n",
+			sc.filePath, sc.timeout, cmd.Process.Pid)
+		killed := sc.terminate(cmd, done)
+		return &exitTimeout{timeout: sc.timeout, killed: killed}
 	case err := <-done:
-		return out.Bytes(), sc.errWrap(err)
+		return sc.exitError(cmd, err)
+	}
+}
+
+// terminate sends SIGTERM to the command's process group, then SIGKILL to
+// whatever is left of it once the command has exited or the grace period
+// has passed, and waits for the command.  It returns true if the command
+// itself had to be killed.
+func (sc *shellCommand) terminate(cmd *exec.Cmd, done <-chan error) bool {
+	pgid := cmd.Process.Pid
+	if err := signalProcessGroup(pgid, syscall.SIGTERM); err != nil {
+		logger.Printf("Failed to terminate %v: %v\n", sc.filePath, err)
+	}
+
+	killed := false
+	select {
+	case <-done:
+	case <-time.After(time.Duration(sc.grace) * time.Second):
+		logger.Printf("Killing %v, which is still running %ds after SIGTERM\n", sc.filePath, sc.grace)
+		killed = true
 	}
 
-	panic("I should not be here")
+	if err := signalProcessGroup(pgid, syscall.SIGKILL); err != nil && killed {
+		logger.Printf("Failed to kill %v: %v\n", sc.filePath, err)
+	}
+
+	if killed {
+		<-done
+	}
+	return killed
+}
+
+// signalProcessGroup sends the signal to every process in the group,
+// ignoring a group that no longer exists
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	if err := syscall.Kill(-pgid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+// exitError returns the error a command exited with, which is one of the
+// handler exit errors where one applies
+func (sc *shellCommand) exitError(cmd *exec.Cmd, err error) error {
+	return limitError(cmd, sc.limits, sc.errWrap(err))
 }
 
 func (sc *shellCommand) errWrap(err error) error {
@@ -86,7 +411,10 @@ func (sc *shellCommand) errWrap(err error) error {
 
 	if msg, ok := err.(*exec.ExitError); ok {
 		status := msg.Sys().(syscall.WaitStatus).ExitStatus()
-		if status == 78 {
+		switch status {
+		case 75:
+			err = &exitTempfail{}
+		case 78:
 			err = &exitNoop{}
 		}
 	}
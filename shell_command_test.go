@@ -1,12 +1,121 @@
 package hookworm
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
+const slowHandlerBody = `#!/bin/sh
+if [ -n "$IGNORE_TERM" ]; then
+    trap '' TERM
+fi
+sleep 30 &
+echo $! > "$CHILD_PID_FILE"
+wait
+`
+
 func TestExitNoopError(t *testing.T) {
 	s := (&exitNoop{}).Error()
 	if s != "exit noop 78" {
 		t.Fail()
 	}
 }
+
+func runSlowHandler(env []string, t *testing.T) (int, time.Duration, error) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "slow.sh")
+	ioutil.WriteFile(filePath, []byte(slowHandlerBody), 0755)
+	pidFile := filepath.Join(dir, "child.pid")
+
+	sc := newShellCommand("sh", filePath, 1, 1)
+	start := time.Now()
+	_, err := sc.runCmd("", "", append(env, "CHILD_PID_FILE="+pidFile), ioutil.Discard, "handle", "github")
+	elapsed := time.Since(start)
+
+	pidBytes, _ := ioutil.ReadFile(pidFile)
+	pid, perr := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if perr != nil {
+		t.Fatalf("handler did not record child pid: %v", perr)
+	}
+
+	return pid, elapsed, err
+}
+
+// processAlive is false for processes that have exited, including those
+// not yet reaped
+func processAlive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+
+	fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+func TestTimeoutTerminatesProcessGroup(t *testing.T) {
+	pid, elapsed, err := runSlowHandler(nil, t)
+
+	timeout, ok := err.(*exitTimeout)
+	if !ok {
+		t.Fatalf("expected timeout error, got %T %v", err, err)
+	}
+
+	if timeout.killed {
+		t.Errorf("expected handler to exit on SIGTERM without being killed")
+	}
+
+	if elapsed > 2*time.Second {
+		t.Errorf("expected handler exiting on SIGTERM not to wait out the grace period, took %v", elapsed)
+	}
+
+	if processAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("expected child process %d to be terminated along with the handler", pid)
+	}
+}
+
+func TestTimeoutKillsAfterGracePeriod(t *testing.T) {
+	pid, elapsed, err := runSlowHandler([]string{"IGNORE_TERM=1"}, t)
+
+	timeout, ok := err.(*exitTimeout)
+	if !ok {
+		t.Fatalf("expected timeout error, got %T %v", err, err)
+	}
+
+	if !timeout.killed || !strings.Contains(timeout.Error(), "killed") {
+		t.Errorf("expected handler ignoring SIGTERM to be killed: %v", timeout)
+	}
+
+	if elapsed < 2*time.Second {
+		t.Errorf("expected grace period to pass before SIGKILL, took %v", elapsed)
+	}
+
+	if processAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("expected child process %d to be killed along with the handler", pid)
+	}
+}
+
+func TestTimeoutHandlerError(t *testing.T) {
+	he := newHandlerError("slow.sh", nil, &exitTimeout{timeout: 1})
+	if !he.TimedOut || he.ExitStatus != -1 {
+		t.Errorf("expected timed out handler error: %+v", he)
+	}
+
+	if newHandlerError("fails.sh", nil, &exitTempfail{}).TimedOut {
+		t.Errorf("expected tempfail not to be reported as a timeout")
+	}
+}
@@ -2,7 +2,13 @@ package hookworm
 
 import (
 	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
 	"path"
+	"strings"
+	"sync"
+	"time"
 )
 
 type shellHandler struct {
@@ -10,6 +16,26 @@ type shellHandler struct {
 	cfg        *HandlerConfig
 	next       Handler
 	configured bool
+	status     *HandlerStatus
+	events     []string
+	filter     *payloadFilter
+	retry      *RetryPolicy
+	output     *OutputPolicy
+	manifest   *manifestHandler
+	persistent bool
+	worker     *persistentWorker
+	forward    *forwarder
+
+	configuring sync.Mutex
+}
+
+// handlerDeclaration is the optional JSON object that a handler executable
+// may write to standard output when invoked with `configure`
+type handlerDeclaration struct {
+	Events     []string       `json:"events"`
+	Filter     *payloadFilter `json:"filter"`
+	Retry      *RetryPolicy   `json:"retry"`
+	Persistent bool           `json:"persistent"`
 }
 
 var (
@@ -24,81 +50,436 @@ var (
 )
 
 func newShellHandler(filePath string, cfg *HandlerConfig) (*shellHandler, error) {
-	handler := &shellHandler{}
+	interpreter, err := resolveInterpreter(filePath, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return newShellHandlerWithInterpreter(interpreter, filePath, cfg), nil
+}
+
+func newShellHandlerWithInterpreter(interpreter, filePath string, cfg *HandlerConfig) *shellHandler {
+	command := newShellCommand(interpreter, filePath, cfg.WormTimeout, cfg.WormKillGrace)
+	command.limits = cfg.Limits
+
+	output := cfg.Output.merge(nil)
+	command.outputMax = output.MaxSize
+	command.sandbox = newSandboxProfile(cfg, nil)
+
+	return &shellHandler{
+		command: command,
+		cfg:     cfg,
+		retry:   cfg.Retry.merge(nil),
+		output:  output,
+	}
+}
+
+// resolveInterpreter returns the interpreter used to run the handler file,
+// which is chosen by file extension from the configured interpreters and
+// then the defaults.  Files with any other extension are executed directly
+// (so that their shebang line applies) if they are executable, and are
+// otherwise rejected.  An empty interpreter means direct execution.
+func resolveInterpreter(filePath string, cfg *HandlerConfig) (string, error) {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%v is not a regular file", filePath)
+	}
+
+	ext := path.Ext(filePath)
+
+	interpreter, ok := cfg.Interpreters[ext]
+	if !ok {
+		interpreter, ok = interpreterMap[ext]
+	}
+
+	if ok {
+		if _, err := exec.LookPath(interpreter); err != nil {
+			return "", fmt.Errorf("interpreter %q for %v is not available: %v", interpreter, filePath, err)
+		}
+		return interpreter, nil
+	}
+
+	if fi.Mode().Perm()&0111 != 0 {
+		return "", nil
+	}
+
+	if ext == "" {
+		return "", fmt.Errorf("%v has no file extension and is not executable; "+
+			"make it executable to run it directly", filePath)
+	}
 
-	fileExtention := path.Ext(filePath)
+	return "", fmt.Errorf("%v is not executable and there is no interpreter for %q files; "+
+		"make it executable to run it directly or add one with -interpreter %s=<command>", filePath, ext, ext)
+}
+
+// newManifestShellHandler builds a shell handler for an entry in the worm
+// manifest, which may override the interpreter, timeout, environment,
+// resource limits, output policy and sandbox along with the events and
+// retry policy declared by the handler itself.  Entries that forward
+// payloads get a handler that POSTs them downstream instead of running a
+// command.
+func newManifestShellHandler(mh *manifestHandler, cfg *HandlerConfig) (*shellHandler, error) {
+	var (
+		handler  *shellHandler
+		err      error
+		filePath = mh.path(cfg.WormDir)
+	)
 
-	handler.cfg = cfg
+	if mh.Forward != nil {
+		handler = newShellHandlerWithInterpreter("", filePath, cfg)
+		handler.forward = mh.Forward
+	} else if mh.Interpreter != "" {
+		if _, err = exec.LookPath(mh.Interpreter); err != nil {
+			return nil, fmt.Errorf("interpreter %q for %v is not available: %v", mh.Interpreter, filePath, err)
+		}
+		handler = newShellHandlerWithInterpreter(mh.Interpreter, filePath, cfg)
+	} else if handler, err = newShellHandler(filePath, cfg); err != nil {
+		return nil, err
+	}
 
-	if interpreter, ok := interpreterMap[fileExtention]; ok {
-		handler.command = newShellCommand(interpreter, filePath, cfg.WormTimeout)
+	if mh.Timeout > 0 {
+		handler.command.timeout = mh.Timeout
 	}
 
+	handler.command.args = mh.Args
+	handler.command.env = mh.environ()
+	handler.command.limits = cfg.Limits.merge(mh.Limits)
+	handler.output = cfg.Output.merge(mh.Output)
+	handler.command.outputMax = handler.output.MaxSize
+	handler.command.sandbox = newSandboxProfile(cfg, mh.Sandbox)
+	handler.manifest = mh
+	handler.events = mh.Events
+	handler.filter = mh.Filter
+	handler.retry = cfg.Retry.merge(mh.Retry)
+	handler.persistent = mh.Persistent != nil && *mh.Persistent
+
 	return handler, nil
 }
 
+// configure runs the handler's configure phase and takes on whatever it
+// declares.  It runs only once per handler, so a handler that fails to
+// configure is marked as failed and skipped until it is reloaded, rather
+// than configured again on every payload.
 func (sh *shellHandler) configure() error {
+	sh.configuring.Lock()
+	defer sh.configuring.Unlock()
+
+	if sh.status != nil {
+		return sh.status.err
+	}
+
+	start := time.Now()
+	err := sh.runConfigure()
+	sh.status = newHandlerStatus(sh.command.filePath, start, err)
+
+	if err != nil {
+		logger.Printf("ERROR: failed to configure %v, skipping it: %v\n", sh.command.filePath, err)
+	} else {
+		logger.Printf("Configured %v in %v\n", sh.command.filePath, time.Since(start))
+	}
+	return err
+}
+
+func (sh *shellHandler) runConfigure() error {
+	if sh.forward != nil {
+		sh.configured = true
+		return nil
+	}
+
 	configJSON, err := json.Marshal(sh.cfg)
 	if err != nil {
 		logger.Printf("Error JSON-marshalling config: %v\n", err)
 	}
 
-	_, err = sh.command.configure(string(configJSON))
-	if err == nil {
-		logger.Debugf("Configured %+v\n", sh)
-		sh.configured = true
+	out, err := sh.command.configure(string(configJSON), sh.cfg.configureTimeout())
+	if err != nil {
+		// a handler that failed to configure is skipped, so it must not be
+		// left with a persistent process either
+		sh.stopWorker()
+		sh.worker = nil
+		return err
 	}
-	return err
+
+	sh.declare(out)
+	logger.Debugf("Configured %+v\n", sh)
+	sh.configured = true
+
+	if sh.persistent && sh.worker == nil {
+		sh.worker = newPersistentWorker(&sh.command, time.Duration(sh.cfg.WorkerHealth)*time.Second)
+		sh.worker.ping()
+	}
+	return nil
+}
+
+// configureStatus returns how configuring the handler went, which is
+// pending until it has been attempted
+func (sh *shellHandler) configureStatus() *HandlerStatus {
+	sh.configuring.Lock()
+	defer sh.configuring.Unlock()
+
+	if sh.status == nil {
+		return &HandlerStatus{Handler: sh.command.filePath, State: handlerPending}
+	}
+	return sh.status
 }
 
-func (sh *shellHandler) HandleGithubPayload(payload string) (string, error) {
-	if !sh.configured {
-		sh.configure()
+// adopt takes on the configuration declared by an older instance of the
+// same, unchanged handler so that it need not be configured again, along
+// with its persistent process, if any
+func (sh *shellHandler) adopt(old *shellHandler) {
+	old.configuring.Lock()
+	defer old.configuring.Unlock()
+
+	sh.configured = old.configured
+	sh.status = old.status
+	sh.events = old.events
+	sh.filter = old.filter
+	sh.retry = old.retry
+	sh.persistent = old.persistent
+	sh.worker = old.worker
+}
+
+// stopWorker shuts down the handler's persistent process, if any
+func (sh *shellHandler) stopWorker() {
+	if sh.worker != nil {
+		sh.worker.stop()
 	}
-	logger.Debugf("Sending github payload to %+v\n", sh)
+}
 
-	noop := false
-	outBytes, err := sh.command.handleGithubPayload(payload)
-	out := string(outBytes)
+func (sh *shellHandler) declare(out []byte) {
+	trimmed := strings.TrimSpace(string(out))
+	if !strings.HasPrefix(trimmed, "{") {
+		return
+	}
 
-	if _, noop = err.(*exitNoop); noop {
-		out = payload
+	decl := &handlerDeclaration{}
+	if err := json.Unmarshal([]byte(trimmed), decl); err != nil {
+		logger.Debugf("Ignoring unparseable configure output from %+v: %v\n", sh, err)
+		return
 	}
 
-	if err != nil && !noop {
-		return out, err
+	if decl.Filter != nil {
+		if err := decl.Filter.compile(); err != nil {
+			logger.Printf("ERROR: ignoring filter declared by %v: %v\n", sh.command.filePath, err)
+			decl.Filter = nil
+		}
 	}
 
-	if sh.next != nil {
-		return sh.next.HandleGithubPayload(out)
+	if sh.manifest != nil {
+		if sh.manifest.Events == nil {
+			sh.events = decl.Events
+		}
+		if sh.manifest.Filter == nil {
+			sh.filter = decl.Filter
+		}
+		if sh.manifest.Persistent == nil {
+			sh.persistent = decl.Persistent
+		}
+		sh.retry = sh.cfg.Retry.merge(decl.Retry).merge(sh.manifest.Retry)
+		return
 	}
 
-	return out, nil
+	sh.events = decl.Events
+	sh.filter = decl.Filter
+	sh.persistent = decl.Persistent
+	sh.retry = sh.cfg.Retry.merge(decl.Retry)
 }
 
-func (sh *shellHandler) HandleTravisPayload(payload string) (string, error) {
-	if !sh.configured {
-		sh.configure()
+// handlesEvent is true unless the handler declared a list of events that
+// does not include the delivery's event.  Deliveries without an event are
+// always handled.
+func (sh *shellHandler) handlesEvent(delivery *Delivery) bool {
+	if len(sh.events) == 0 || delivery.Event == "" {
+		return true
+	}
+
+	for _, event := range sh.events {
+		if event == delivery.Event {
+			return true
+		}
+	}
+
+	return false
+}
+
+// handlesSource is true unless the handler's manifest entry lists sources
+// that do not include the delivery's source
+func (sh *shellHandler) handlesSource(delivery *Delivery) bool {
+	if sh.manifest == nil || len(sh.manifest.Sources) == 0 {
+		return true
+	}
+
+	for _, source := range sh.manifest.Sources {
+		if source == delivery.Source {
+			return true
+		}
 	}
-	logger.Debugf("Sending travis payload to %+v\n", sh)
 
-	noop := false
-	outBytes, err := sh.command.handleTravisPayload(payload)
-	out := string(outBytes)
+	return false
+}
 
-	if _, noop = err.(*exitNoop); noop {
-		out = payload
+func (sh *shellHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	outcome, err := sh.handle(delivery, payload)
+	if err != nil {
+		return outcome.payload, err
 	}
 
-	if err != nil && !noop {
-		return out, err
+	if outcome.stop {
+		logger.Printf("Stopping pipeline after %v for delivery %s\n", sh.command.filePath, delivery.ID)
+		return outcome.payload, nil
 	}
 
 	if sh.next != nil {
-		return sh.next.HandleTravisPayload(out)
+		return sh.next.HandlePayload(delivery, outcome.payload)
+	}
+
+	return outcome.payload, nil
+}
+
+// handle runs this handler alone, returning the payload for the next
+// handler, whether it actually handled the payload (i.e. was not skipped
+// and did not no-op) and whether it asked for the pipeline to stop.  The
+// result of running the handler is recorded in the delivery.
+func (sh *shellHandler) handle(delivery *Delivery, payload string) (*handlerOutcome, error) {
+	skipped := &handlerOutcome{payload: payload}
+
+	if err := sh.configure(); err != nil {
+		logger.Debugf("Skipping %+v, which failed to configure\n", sh)
+		delivery.AddResult(&HandlerResult{Handler: sh.command.filePath, Status: resultUnconfigured, Error: err.Error()})
+		return skipped, nil
+	}
+
+	if !sh.handlesSource(delivery) || !sh.handlesEvent(delivery) {
+		logger.Debugf("Skipping %+v, which does not handle %s %q events\n", sh, delivery.Source, delivery.Event)
+		return skipped, nil
+	}
+
+	if !sh.filter.matches(delivery, payload) {
+		logger.Debugf("Skipping %+v, whose filter does not match %s payload\n", sh, delivery.Source)
+		return skipped, nil
+	}
+
+	logger.Debugf("Sending %s payload to %+v\n", delivery.Source, sh)
+
+	output, err := sh.handleWithRetries(delivery, payload)
+	outcome := &handlerOutcome{payload: string(output.out), handled: true}
+	result := &HandlerResult{Handler: sh.command.filePath, Stderr: string(output.stderr)}
+
+	if envelope := output.envelope; envelope != nil {
+		result.Annotations = envelope.Annotations
+		result.Messages = envelope.Messages
+
+		for _, message := range envelope.Messages {
+			logger.Printf("%v: %s\n", path.Base(sh.command.filePath), message)
+		}
+
+		if p, ok := envelope.payload(); ok {
+			outcome.payload = p
+		}
+		if envelope.Status == resultUnchanged {
+			outcome.payload = payload
+		}
+		outcome.stop = envelope.Stop
+	}
+
+	if err == nil && outcome.payload != payload {
+		if invalid := sh.output.check(outcome.payload); invalid != nil {
+			if sh.output.OnInvalid != outputInput {
+				err = invalid
+			} else {
+				logger.Printf("ERROR: passing along the input of %v for delivery %s in place of its %v\n",
+					sh.command.filePath, delivery.ID, invalid)
+				outcome.payload = payload
+				result.Error = invalid.Error()
+			}
+		}
+	}
+
+	switch err.(type) {
+	case nil:
+		result.Status = resultChanged
+		if outcome.payload == payload {
+			result.Status = resultUnchanged
+		}
+	case *exitNoop:
+		result.Status = resultNoop
+		outcome.payload, outcome.handled = payload, false
+	default:
+		switch {
+		case isTimeout(err):
+			result.Status = resultTimeout
+		case isTransient(err):
+			result.Status = resultTempfail
+		default:
+			result.Status = resultFailed
+		}
+		result.Error = err.Error()
+
+		if limit := exceededLimit(err); limit != "" {
+			logger.Printf("ERROR: %v exceeded its %s resource limit for delivery %s\n",
+				sh.command.filePath, limit, delivery.ID)
+		}
+		outcome.stop = false
+	}
+
+	result.Stop = outcome.stop
+	delivery.AddResult(result)
+
+	if err == nil || result.Status == resultNoop {
+		return outcome, nil
+	}
+
+	if sh.manifest == nil || sh.manifest.OnFailure != failureContinue {
+		return outcome, newHandlerError(sh.command.filePath, output.stderr, err)
+	}
+
+	logger.Printf("Continuing past failure of %v for delivery %s: %v\n",
+		sh.command.filePath, delivery.ID, err)
+	return skipped, nil
+}
+
+// handleWithRetries runs the handler command, retrying transient failures
+// according to the handler's retry policy.  Only this stage is retried, so
+// handlers earlier in the pipeline are not run again.  A status given in a
+// result envelope is only consulted when the handler otherwise succeeded.
+func (sh *shellHandler) handleWithRetries(delivery *Delivery, payload string) (*handlerOutput, error) {
+	for attempt := 1; ; attempt++ {
+		output, err := sh.run(delivery, payload)
+		if err == nil && output.envelope != nil {
+			err = output.envelope.statusError()
+		}
+
+		if !isTransient(err) || attempt >= sh.retry.MaxAttempts {
+			return output, err
+		}
+
+		delay := sh.retry.delay(attempt)
+		logger.Printf("Retrying %v for delivery %s in %v after attempt %d/%d: %v\n",
+			sh.command.filePath, delivery.ID, delay, attempt, sh.retry.MaxAttempts, err)
+		time.Sleep(delay)
+	}
+}
+
+// run sends the payload to the handler's persistent process if it has one,
+// or downstream if it forwards payloads, and otherwise runs the handler
+// command for this payload alone
+func (sh *shellHandler) run(delivery *Delivery, payload string) (*handlerOutput, error) {
+	if sh.forward != nil {
+		return sh.forward.forward(delivery, payload, sh.command.timeout, sh.output.MaxSize)
+	}
+
+	if sh.worker != nil {
+		output, err := sh.worker.handle(delivery, payload)
+		if err != errWorkerStopped {
+			return output, err
+		}
 	}
 
-	return out, nil
+	return sh.command.handlePayload(delivery, payload)
 }
 
 func (sh *shellHandler) SetNextHandler(n Handler) {
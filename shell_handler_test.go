@@ -1,21 +1,67 @@
 package hookworm
 
 import (
+	"encoding/json"
+	"fmt"
 	"os"
 	"path"
 	"strings"
 	"testing"
 )
 
-const noopHandlerBody = `#!/usr/bin/env python
+const (
+	noopHandlerBody = `#!/usr/bin/env python
 import sys
 
 sys.stdout.write(sys.stdin.read())
 sys.exit(0)
 `
+	eventHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+
+if sys.argv[1] == 'configure':
+    json.dump({'events': ['push', 'delete']}, sys.stdout)
+    sys.exit(0)
+
+json.dump({
+    'argv': sys.argv[1:],
+    'event': os.environ.get('HOOKWORM_EVENT'),
+    'delivery': os.environ.get('HOOKWORM_DELIVERY'),
+    'source_delivery': os.environ.get('HOOKWORM_SOURCE_DELIVERY'),
+}, sys.stdout)
+sys.exit(0)
+`
+	flakyHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+import tempfile
+
+if sys.argv[1] == 'configure':
+    json.dump({'retry': {'max_attempts': 3, 'initial_delay': 0.01}}, sys.stdout)
+    sys.exit(0)
+
+counter = os.path.join(tempfile.gettempdir(),
+                       'hookworm-test-flaky-' + os.environ['HOOKWORM_DELIVERY'])
+attempts = 1
+if os.path.exists(counter):
+    attempts = int(open(counter).read()) + 1
+open(counter, 'w').write(str(attempts))
+
+if attempts < int(os.environ['HOOKWORM_DELIVERY'].split('-')[-1]):
+    sys.exit(75)
+
+sys.stdout.write(sys.stdin.read())
+sys.exit(0)
+`
+)
 
 var (
-	noopHandlerPath = ""
+	noopHandlerPath  = ""
+	eventHandlerPath = ""
+	flakyHandlerPath = ""
 
 	shellHandlerConfig = &HandlerConfig{
 		WormTimeout: 5,
@@ -23,19 +69,29 @@ var (
 	}
 )
 
-func init() {
-	f, err := os.Create(path.Join(os.TempDir(), "hookworm-test-noop-handler.py"))
+func setupTestHandlers() {
+	noopHandlerPath = writeTestHandler("hookworm-test-noop-handler.py", noopHandlerBody)
+	eventHandlerPath = writeTestHandler("hookworm-test-event-handler.py", eventHandlerBody)
+	flakyHandlerPath = writeTestHandler("hookworm-test-flaky-handler.py", flakyHandlerBody)
+}
+
+func writeTestHandler(name, body string) string {
+	f, err := os.Create(path.Join(os.TempDir(), name))
 	if err != nil {
 		panic(err)
 	}
-	noopHandlerPath = f.Name()
 	defer f.Close()
-	f.WriteString(noopHandlerBody)
+	f.WriteString(body)
 	f.Chmod(0755)
+	return f.Name()
 }
 
 func setupShellHandler(t *testing.T) *shellHandler {
-	sh, err := newShellHandler(noopHandlerPath, shellHandlerConfig)
+	return setupShellHandlerFor(noopHandlerPath, t)
+}
+
+func setupShellHandlerFor(handlerPath string, t *testing.T) *shellHandler {
+	sh, err := newShellHandler(handlerPath, shellHandlerConfig)
 	if err != nil {
 		t.Error(err)
 	}
@@ -54,12 +110,168 @@ func assertNoopWorks(out string, err error, t *testing.T) {
 
 func TestShellHandlerHandleGithubPayload(t *testing.T) {
 	sh := setupShellHandler(t)
-	out, err := sh.HandleGithubPayload(`{}`)
+	out, err := sh.HandlePayload(&Delivery{Source: "github"}, `{}`)
 	assertNoopWorks(out, err, t)
 }
 
 func TestShellHandlerHandleTravisPayload(t *testing.T) {
 	sh := setupShellHandler(t)
-	out, err := sh.HandleTravisPayload(`{}`)
+	out, err := sh.HandlePayload(&Delivery{Source: "travis"}, `{}`)
+	assertNoopWorks(out, err, t)
+}
+
+func TestShellHandlerPassesEventAndDelivery(t *testing.T) {
+	sh := setupShellHandlerFor(eventHandlerPath, t)
+	out, err := sh.HandlePayload(&Delivery{ID: "abc-123", SourceID: "gh-1", Source: "github", Event: "push"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := &struct {
+		Argv           []string `json:"argv"`
+		Event          string   `json:"event"`
+		Delivery       string   `json:"delivery"`
+		SourceDelivery string   `json:"source_delivery"`
+	}{}
+	if err := json.Unmarshal([]byte(out), seen); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(seen.Argv, " ") != "handle github push" {
+		t.Errorf("unexpected argv %v", seen.Argv)
+	}
+	if seen.Event != "push" || seen.Delivery != "abc-123" || seen.SourceDelivery != "gh-1" {
+		t.Errorf("unexpected env %+v", seen)
+	}
+}
+
+func TestShellHandlerHandleExtraSourcePayload(t *testing.T) {
+	sh := setupShellHandlerFor(eventHandlerPath, t)
+	out, err := sh.HandlePayload(&Delivery{Source: "deploys"}, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := &struct {
+		Argv []string `json:"argv"`
+	}{}
+	if err := json.Unmarshal([]byte(out), seen); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(seen.Argv, " ") != "handle deploys" {
+		t.Errorf("unexpected argv %v", seen.Argv)
+	}
+}
+
+func TestShellHandlerSkipsUndeclaredEvents(t *testing.T) {
+	sh := setupShellHandlerFor(eventHandlerPath, t)
+	out, err := sh.HandlePayload(&Delivery{Source: "github", Event: "pull_request"}, `{}`)
 	assertNoopWorks(out, err, t)
+	if len(sh.events) != 2 {
+		t.Errorf("expected declared events, got %v", sh.events)
+	}
+}
+
+type countingHandler struct {
+	count int
+	next  Handler
+}
+
+func (ch *countingHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
+	ch.count++
+	return ch.next.HandlePayload(delivery, payload)
+}
+
+func (ch *countingHandler) SetNextHandler(n Handler) {
+	ch.next = n
+}
+
+func (ch *countingHandler) NextHandler() Handler {
+	return ch.next
+}
+
+// flakyDelivery returns a delivery that the flaky handler fails with exit 75
+// until the given attempt
+func flakyDelivery(succeedOn int) *Delivery {
+	id := fmt.Sprintf("%s-%d", newDeliveryID(), succeedOn)
+	os.Remove(path.Join(os.TempDir(), "hookworm-test-flaky-"+id))
+	return &Delivery{ID: id, Source: "github"}
+}
+
+func TestShellHandlerRetriesTransientFailures(t *testing.T) {
+	first := &countingHandler{}
+	sh := setupShellHandlerFor(flakyHandlerPath, t)
+	first.SetNextHandler(sh)
+
+	out, err := first.HandlePayload(flakyDelivery(3), `{}`)
+	assertNoopWorks(out, err, t)
+
+	if first.count != 1 {
+		t.Errorf("earlier stage ran %d times", first.count)
+	}
+	if sh.retry.MaxAttempts != 3 || sh.retry.Backoff != 1 {
+		t.Errorf("unexpected retry policy %+v", sh.retry)
+	}
+}
+
+func TestShellHandlerGivesUpAfterMaxAttempts(t *testing.T) {
+	sh := setupShellHandlerFor(flakyHandlerPath, t)
+	_, err := sh.HandlePayload(flakyDelivery(4), `{}`)
+	he, ok := err.(*handlerError)
+	if !ok {
+		t.Fatalf("expected handler error, got %v", err)
+	}
+	if _, ok := he.Err.(*exitTempfail); !ok || he.ExitStatus != 75 || he.Handler != flakyHandlerPath {
+		t.Errorf("unexpected handler error %+v", he)
+	}
+}
+
+func TestShellHandlerRunsExecutablesDirectly(t *testing.T) {
+	directPath := writeTestHandler("hookworm-test-direct-handler", noopHandlerBody)
+
+	sh := setupShellHandlerFor(directPath, t)
+	if sh.command.interpreter != "" {
+		t.Errorf("unexpected interpreter %q", sh.command.interpreter)
+	}
+
+	out, err := sh.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	assertNoopWorks(out, err, t)
+}
+
+func TestShellHandlerUsesConfiguredInterpreters(t *testing.T) {
+	pyxPath := writeTestHandler("hookworm-test-handler.pyx", noopHandlerBody)
+	os.Chmod(pyxPath, 0644)
+
+	cfg := *shellHandlerConfig
+	cfg.Interpreters = map[string]string{".pyx": "python"}
+
+	sh, err := newShellHandler(pyxPath, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := sh.HandlePayload(&Delivery{Source: "github"}, `{}`)
+	assertNoopWorks(out, err, t)
+}
+
+func TestShellHandlerRejectsUnrunnableFiles(t *testing.T) {
+	unknownPath := writeTestHandler("hookworm-test-handler.unknown", noopHandlerBody)
+	os.Chmod(unknownPath, 0644)
+	plainPath := writeTestHandler("hookworm-test-plain-handler", noopHandlerBody)
+	os.Chmod(plainPath, 0644)
+
+	missingCfg := *shellHandlerConfig
+	missingCfg.Interpreters = map[string]string{".py": "hookworm-no-such-interpreter"}
+
+	for filePath, cfg := range map[string]*HandlerConfig{
+		unknownPath:     shellHandlerConfig,
+		plainPath:       shellHandlerConfig,
+		os.TempDir():    shellHandlerConfig,
+		noopHandlerPath: &missingCfg,
+	} {
+		if _, err := newShellHandler(filePath, cfg); err == nil {
+			t.Errorf("expected %v to be rejected", filePath)
+		}
+	}
 }
@@ -0,0 +1,276 @@
+package hookworm
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type hubSignatureHeader struct {
+	header string
+	prefix string
+	hash   func() hash.Hash
+}
+
+var (
+	githubSignatureHeaders = []hubSignatureHeader{
+		{"X-Hub-Signature-256", "sha256=", sha256.New},
+		{"X-Hub-Signature", "sha1=", sha1.New},
+	}
+	bitbucketSignatureHeaders = []hubSignatureHeader{
+		{"X-Hub-Signature", "sha256=", sha256.New},
+	}
+)
+
+// githubSignatureVerifier returns a martini handler that rejects any request
+// whose body does not match the GitHub HMAC signature headers for the given
+// secret.  An empty secret disables verification.
+func githubSignatureVerifier(secret string) func(*hookwormLogger, http.ResponseWriter, *http.Request) {
+	return func(l *hookwormLogger, w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			return
+		}
+
+		if err := verifyGithubSignature(secret, r); err != nil {
+			l.Printf("Rejecting github payload from %v: %v\n", r.RemoteAddr, err)
+			writeUnauthorized(w, err)
+		}
+	}
+}
+
+func verifyGithubSignature(secret string, r *http.Request) error {
+	return verifyHubSignature(secret, r, githubSignatureHeaders)
+}
+
+// bitbucketSignatureVerifier returns a martini handler that rejects any
+// request whose body does not match the Bitbucket HMAC signature header for
+// the given secret.  An empty secret disables verification.
+func bitbucketSignatureVerifier(secret string) func(*hookwormLogger, http.ResponseWriter, *http.Request) {
+	return func(l *hookwormLogger, w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			return
+		}
+
+		if err := verifyBitbucketSignature(secret, r); err != nil {
+			l.Printf("Rejecting bitbucket payload from %v: %v\n", r.RemoteAddr, err)
+			writeUnauthorized(w, err)
+		}
+	}
+}
+
+func verifyBitbucketSignature(secret string, r *http.Request) error {
+	return verifyHubSignature(secret, r, bitbucketSignatureHeaders)
+}
+
+// verifyHubSignature checks every one of the given signature headers that is
+// present against the HMAC of the request body, requiring at least one.
+func verifyHubSignature(secret string, r *http.Request, headers []hubSignatureHeader) error {
+	body, err := readAndRestoreBody(r)
+	if err != nil {
+		return err
+	}
+
+	var (
+		checked int
+		names   []string
+	)
+
+	for _, sig := range headers {
+		names = append(names, sig.header)
+
+		value := r.Header.Get(sig.header)
+		if value == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(value, sig.prefix) {
+			return fmt.Errorf("malformed %s header", sig.header)
+		}
+
+		expected, err := hex.DecodeString(strings.TrimPrefix(value, sig.prefix))
+		if err != nil {
+			return fmt.Errorf("malformed %s header: %v", sig.header, err)
+		}
+
+		mac := hmac.New(sig.hash, []byte(secret))
+		mac.Write(body)
+		if !hmac.Equal(mac.Sum(nil), expected) {
+			return fmt.Errorf("%s mismatch", sig.header)
+		}
+
+		checked++
+	}
+
+	if checked == 0 {
+		return fmt.Errorf("missing %s header", strings.Join(names, " or "))
+	}
+
+	return nil
+}
+
+// signHubPayload sets each of the HMAC signature headers for the body and
+// secret, as expected by verifyHubSignature
+func signHubPayload(secret string, body []byte, headers []hubSignatureHeader, h http.Header) {
+	for _, sig := range headers {
+		mac := hmac.New(sig.hash, []byte(secret))
+		mac.Write(body)
+		h.Set(sig.header, sig.prefix+hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// travisSignatureVerifier returns a martini handler that rejects any request
+// whose payload does not match the Travis `Signature` header for the given
+// public key.  A nil key disables verification.
+func travisSignatureVerifier(key *rsa.PublicKey) func(*hookwormLogger, http.ResponseWriter, *http.Request) {
+	return func(l *hookwormLogger, w http.ResponseWriter, r *http.Request) {
+		if key == nil {
+			return
+		}
+
+		if err := verifyTravisSignature(key, r); err != nil {
+			l.Printf("Rejecting travis payload from %v: %v\n", r.RemoteAddr, err)
+			writeUnauthorized(w, err)
+		}
+	}
+}
+
+func verifyTravisSignature(key *rsa.PublicKey, r *http.Request) error {
+	value := r.Header.Get("Signature")
+	if value == "" {
+		return fmt.Errorf("missing Signature header")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("malformed Signature header: %v", err)
+	}
+
+	body, err := readAndRestoreBody(r)
+	if err != nil {
+		return err
+	}
+
+	// Travis signs the value of the `payload` form field rather than the
+	// whole request body.
+	payload := body
+	if abbrCtype(r.Header.Get("Content-Type")) == "application/x-www-form-urlencoded" {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return err
+		}
+		payload = []byte(values.Get("payload"))
+	}
+
+	digest := sha1.Sum(payload)
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA1, digest[:], signature); err != nil {
+		return fmt.Errorf("Signature mismatch")
+	}
+
+	return nil
+}
+
+// gitlabTokenVerifier returns a martini handler that rejects any request
+// whose `X-Gitlab-Token` header does not match the given secret.  An empty
+// secret disables verification.
+func gitlabTokenVerifier(secret string) func(*hookwormLogger, http.ResponseWriter, *http.Request) {
+	return func(l *hookwormLogger, w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			return
+		}
+
+		if err := verifyGitlabToken(secret, r); err != nil {
+			l.Printf("Rejecting gitlab payload from %v: %v\n", r.RemoteAddr, err)
+			writeUnauthorized(w, err)
+		}
+	}
+}
+
+func verifyGitlabToken(secret string, r *http.Request) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		return fmt.Errorf("missing X-Gitlab-Token header")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return fmt.Errorf("X-Gitlab-Token mismatch")
+	}
+
+	return nil
+}
+
+// loadTravisPublicKey reads a PEM-encoded RSA public key such as the one
+// served by the Travis config API.  An empty path yields a nil key.
+func loadTravisPublicKey(keyPath string) (*rsa.PublicKey, error) {
+	if keyPath == "" {
+		return nil, nil
+	}
+
+	pemBytes, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in travis public key %v", keyPath)
+	}
+
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("travis public key %v is not an RSA key", keyPath)
+	}
+
+	return key, nil
+}
+
+// readAndRestoreBody slurps the request body and replaces it with an
+// equivalent reader so that later payload extraction sees the same bytes.
+func readAndRestoreBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return []byte{}, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	errJSON, jsonErr := json.Marshal(map[string]string{"error": err.Error()})
+	if jsonErr != nil {
+		errJSON = []byte(boomExplosionsJSON)
+	}
+
+	w.Header().Set("Content-Type", ctypeJSON)
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(errJSON)
+}
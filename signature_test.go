@@ -0,0 +1,318 @@
+package hookworm
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const githubTestSecret = "s3kr1t"
+
+var (
+	travisTestKey        *rsa.PrivateKey
+	travisTestPubkeyPath = path.Join(os.TempDir(), "hookworm-test-travis.pem")
+)
+
+func setupTravisTestKey() {
+	var err error
+	travisTestKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+
+	pubBytes, err := x509.MarshalPKIXPublicKey(&travisTestKey.PublicKey)
+	if err != nil {
+		panic(err)
+	}
+
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	if err = ioutil.WriteFile(travisTestPubkeyPath, pemBytes, 0640); err != nil {
+		panic(err)
+	}
+}
+
+func githubSign(h func() hash.Hash, prefix, secret, body string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(body))
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newGithubSignedRequest(body string, headers map[string]string) *http.Request {
+	req, err := http.NewRequest("POST", "/github-test", strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func getSignedGithubResponse(headers map[string]string) *httptest.ResponseRecorder {
+	cfg := *serverTestConfig
+	cfg.GithubSecret = githubTestSecret
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, newGithubSignedRequest(getPayload("github", "valid"), headers))
+	return hr
+}
+
+func TestVerifyGithubSignatureSHA256(t *testing.T) {
+	body := getPayload("github", "valid")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature-256": githubSign(sha256.New, "sha256=", githubTestSecret, body),
+	})
+
+	if err := verifyGithubSignature(githubTestSecret, req); err != nil {
+		t.Error(err)
+	}
+
+	restored, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(restored) != body {
+		t.Errorf("body was not restored after verification")
+	}
+}
+
+func TestVerifyGithubSignatureSHA1(t *testing.T) {
+	body := getPayload("github", "valid")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature": githubSign(sha1.New, "sha1=", githubTestSecret, body),
+	})
+
+	if err := verifyGithubSignature(githubTestSecret, req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyGithubSignatureRejectsWrongSecret(t *testing.T) {
+	body := getPayload("github", "valid")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature-256": githubSign(sha256.New, "sha256=", "nope", body),
+	})
+
+	if verifyGithubSignature(githubTestSecret, req) == nil {
+		t.Fail()
+	}
+}
+
+func TestVerifyGithubSignatureRejectsAnyMismatch(t *testing.T) {
+	body := getPayload("github", "valid")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature-256": githubSign(sha256.New, "sha256=", githubTestSecret, body),
+		"X-Hub-Signature":     githubSign(sha1.New, "sha1=", "nope", body),
+	})
+
+	if verifyGithubSignature(githubTestSecret, req) == nil {
+		t.Fail()
+	}
+}
+
+func TestVerifyGithubSignatureRejectsMissingHeaders(t *testing.T) {
+	req := newGithubSignedRequest(getPayload("github", "valid"), nil)
+	if verifyGithubSignature(githubTestSecret, req) == nil {
+		t.Fail()
+	}
+}
+
+func TestServerAcceptsSignedGithubPayload(t *testing.T) {
+	body := getPayload("github", "valid")
+	resp := getSignedGithubResponse(map[string]string{
+		"X-Hub-Signature-256": githubSign(sha256.New, "sha256=", githubTestSecret, body),
+	})
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsUnsignedGithubPayload(t *testing.T) {
+	resp := getSignedGithubResponse(nil)
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsBadlySignedGithubPayload(t *testing.T) {
+	resp := getSignedGithubResponse(map[string]string{
+		"X-Hub-Signature": "sha1=deadbeef",
+	})
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestVerifyBitbucketSignature(t *testing.T) {
+	body := getPayload("bitbucket", "repo_push")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature": githubSign(sha256.New, "sha256=", githubTestSecret, body),
+	})
+
+	if err := verifyBitbucketSignature(githubTestSecret, req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestVerifyBitbucketSignatureRejectsSHA1(t *testing.T) {
+	body := getPayload("bitbucket", "repo_push")
+	req := newGithubSignedRequest(body, map[string]string{
+		"X-Hub-Signature": githubSign(sha1.New, "sha1=", githubTestSecret, body),
+	})
+
+	if verifyBitbucketSignature(githubTestSecret, req) == nil {
+		t.Fail()
+	}
+}
+
+func travisSign(key *rsa.PrivateKey, payload string) string {
+	digest := sha1.Sum([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func getSignedTravisResponse(name, signature string) *httptest.ResponseRecorder {
+	cfg := *serverTestConfig
+	cfg.TravisPubkey = travisTestPubkeyPath
+
+	m, err := NewServer("", &cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	req, err := http.NewRequest("POST", "/travis-test", getPayloadFormReader("travis", name))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if signature != "" {
+		req.Header.Set("Signature", signature)
+	}
+
+	hr := httptest.NewRecorder()
+	m.ServeHTTP(hr, req)
+	return hr
+}
+
+func TestLoadTravisPublicKey(t *testing.T) {
+	key, err := loadTravisPublicKey(travisTestPubkeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.N.Cmp(travisTestKey.PublicKey.N) != 0 {
+		t.Fail()
+	}
+}
+
+func TestLoadTravisPublicKeyEmptyPath(t *testing.T) {
+	key, err := loadTravisPublicKey("")
+	if key != nil || err != nil {
+		t.Fail()
+	}
+}
+
+func TestLoadTravisPublicKeyRejectsGarbage(t *testing.T) {
+	garbagePath := path.Join(os.TempDir(), "hookworm-test-travis-garbage.pem")
+	ioutil.WriteFile(garbagePath, []byte("not a key"), 0640)
+	if _, err := loadTravisPublicKey(garbagePath); err == nil {
+		t.Fail()
+	}
+}
+
+func TestVerifyTravisSignatureForm(t *testing.T) {
+	for _, name := range []string{"valid", "success", "annotated_success"} {
+		payload := getPayload("travis", name)
+		body := url.Values{"payload": []string{payload}}.Encode()
+		req, _ := http.NewRequest("POST", "/travis-test", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Signature", travisSign(travisTestKey, payload))
+
+		if err := verifyTravisSignature(&travisTestKey.PublicKey, req); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if req.FormValue("payload") != payload {
+			t.Errorf("%s: payload was not restored after verification", name)
+		}
+	}
+}
+
+func TestVerifyTravisSignatureJSON(t *testing.T) {
+	payload := getPayload("travis", "valid")
+	req, _ := http.NewRequest("POST", "/travis-test", strings.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Signature", travisSign(travisTestKey, payload))
+
+	if err := verifyTravisSignature(&travisTestKey.PublicKey, req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerAcceptsSignedTravisPayload(t *testing.T) {
+	resp := getSignedTravisResponse("success",
+		travisSign(travisTestKey, getPayload("travis", "success")))
+	if resp.Code != 204 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsUnsignedTravisPayload(t *testing.T) {
+	resp := getSignedTravisResponse("success", "")
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsMissignedTravisPayload(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := getSignedTravisResponse("success",
+		travisSign(otherKey, getPayload("travis", "success")))
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
+
+func TestServerRejectsTravisPayloadSignedForAnotherPayload(t *testing.T) {
+	resp := getSignedTravisResponse("success",
+		travisSign(travisTestKey, getPayload("travis", "annotated_success")))
+	if resp.Code != 401 {
+		fmt.Println(resp.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,72 @@
+package hookworm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	reservedSourceNames = map[string]bool{
+		"bitbucket": true,
+		"github":    true,
+		"gitlab":    true,
+		"travis":    true,
+	}
+)
+
+// sourceMap maps extra webhook source names to the paths at which their
+// payloads are received, and is usable as a repeatable flag value
+type sourceMap map[string]string
+
+func (sm sourceMap) String() string {
+	var names []string
+	for name := range sm {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	s := ""
+	for _, name := range names {
+		s += fmt.Sprintf("%s=%s;", name, sm[name])
+	}
+	return s
+}
+
+// Set accepts one or more `name=/path` pairs separated by `;`.  A bare name
+// is received at `/name`.
+func (sm sourceMap) Set(value string) error {
+	for _, pair := range strings.Split(value, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		sourcePath := "/" + name
+		if len(parts) == 2 {
+			sourcePath = strings.TrimSpace(parts[1])
+		}
+
+		if name == "" {
+			return fmt.Errorf("invalid source %q: missing name", pair)
+		}
+
+		if strings.ContainsAny(name, " \t/") {
+			return fmt.Errorf("invalid source name %q", name)
+		}
+
+		if reservedSourceNames[name] {
+			return fmt.Errorf("invalid source name %q: reserved", name)
+		}
+
+		if !strings.HasPrefix(sourcePath, "/") {
+			return fmt.Errorf("invalid source path %q: must begin with /", sourcePath)
+		}
+
+		sm[name] = sourcePath
+	}
+
+	return nil
+}
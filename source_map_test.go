@@ -0,0 +1,46 @@
+package hookworm
+
+import (
+	"testing"
+)
+
+func TestSourceMapSet(t *testing.T) {
+	sm := sourceMap{}
+	if err := sm.Set("deploys=/deploys-in; alerts"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sm["deploys"] != "/deploys-in" {
+		t.Fail()
+	}
+	if sm["alerts"] != "/alerts" {
+		t.Fail()
+	}
+}
+
+func TestSourceMapString(t *testing.T) {
+	sm := sourceMap{}
+	sm.Set("zed=/z")
+	sm.Set("alpha=/a")
+	if sm.String() != "alpha=/a;zed=/z;" {
+		t.Errorf("unexpected string %q", sm.String())
+	}
+}
+
+func TestSourceMapSetIgnoresEmptyishValues(t *testing.T) {
+	sm := sourceMap{}
+	if err := sm.Set("  ;  ; "); err != nil {
+		t.Error(err)
+	}
+	if len(sm) != 0 {
+		t.Fail()
+	}
+}
+
+func TestSourceMapSetRejectsBadValues(t *testing.T) {
+	for _, value := range []string{"bitbucket", "github=/gh", "gitlab", "travis", "=/nameless", "de ploys=/d", "deploys=deploys"} {
+		if err := (sourceMap{}).Set(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package hookworm
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	stderrLogDirName = "stderr"
+
+	// stderrLogMaxSize is the most that is written to a single delivery's
+	// stderr log, beyond which lines are dropped
+	stderrLogMaxSize = 1 << 20
+
+	// stderrLineMaxSize is the longest line logged, beyond which what has
+	// been written without a newline is logged as a truncated line
+	stderrLineMaxSize = stderrTailSize
+)
+
+// lineLogger is an io.Writer that logs each line written to it with a
+// prefix naming the handler and delivery, so that the standard error of
+// concurrent handlers may be told apart, and also appends it to the
+// delivery's stderr log, if any
+type lineLogger struct {
+	sync.Mutex
+	prefix string
+	log    *deliveryLog
+	buf    []byte
+}
+
+func newLineLogger(handler string, delivery *Delivery) *lineLogger {
+	ll := &lineLogger{prefix: path.Base(handler)}
+	if delivery != nil {
+		if delivery.ID != "" {
+			ll.prefix += "[" + delivery.ID + "]"
+		}
+
+		delivery.mu.Lock()
+		ll.log = delivery.stderrLog
+		delivery.mu.Unlock()
+	}
+	return ll
+}
+
+func (ll *lineLogger) Write(p []byte) (int, error) {
+	ll.Lock()
+	defer ll.Unlock()
+
+	ll.buf = append(ll.buf, p...)
+	for {
+		i := bytes.IndexByte(ll.buf, '\n')
+		if i < 0 {
+			break
+		}
+		ll.writeLine(ll.buf[:i])
+		ll.buf = ll.buf[i+1:]
+	}
+
+	for len(ll.buf) >= stderrLineMaxSize {
+		ll.writeLine(append(ll.buf[:stderrLineMaxSize:stderrLineMaxSize], " (truncated)"...))
+		ll.buf = ll.buf[stderrLineMaxSize:]
+	}
+
+	return len(p), nil
+}
+
+// flush writes out anything left after the last complete line
+func (ll *lineLogger) flush() {
+	ll.Lock()
+	defer ll.Unlock()
+
+	if len(ll.buf) > 0 {
+		ll.writeLine(ll.buf)
+		ll.buf = nil
+	}
+}
+
+func (ll *lineLogger) writeLine(line []byte) {
+	logger.Printf("%s: %s\n", ll.prefix, line)
+	if ll.log != nil {
+		ll.log.writeLine(ll.prefix, line)
+	}
+}
+
+// deliveryLog is the file to which the standard error of every handler
+// run for a single delivery is written
+type deliveryLog struct {
+	sync.Mutex
+	file    *os.File
+	written int
+	dropped bool
+}
+
+func (dl *deliveryLog) writeLine(prefix string, line []byte) {
+	dl.Lock()
+	defer dl.Unlock()
+
+	entry := fmt.Sprintf("%s: %s\n", prefix, line)
+	if dl.written+len(entry) > stderrLogMaxSize {
+		if !dl.dropped {
+			fmt.Fprintf(dl.file, "(truncated at %d bytes)\n", stderrLogMaxSize)
+			dl.dropped = true
+		}
+		return
+	}
+
+	n, _ := dl.file.WriteString(entry)
+	dl.written += n
+}
+
+func (dl *deliveryLog) close() error {
+	dl.Lock()
+	defer dl.Unlock()
+
+	return dl.file.Close()
+}
+
+// stderrLogStore keeps a stderr log file for each of the most recent
+// deliveries, removing the oldest once there are more than keep
+type stderrLogStore struct {
+	sync.Mutex
+	dir  string
+	keep int
+}
+
+func openStderrLogStore(workingDir string, keep int) (*stderrLogStore, error) {
+	dir := filepath.Join(workingDir, stderrLogDirName)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &stderrLogStore{dir: dir, keep: keep}, nil
+}
+
+// open starts the stderr log of the delivery, which is written to by every
+// handler subsequently run for it
+func (sls *stderrLogStore) open(d *Delivery) error {
+	logPath := filepath.Join(sls.dir, stderrLogName(d.ID))
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.StderrLog = logPath
+	d.stderrLog = &deliveryLog{file: file}
+	d.mu.Unlock()
+
+	return nil
+}
+
+// safeFileName returns a file name for a delivery ID (which may come from a
+// request header), replacing any characters that are unsafe in a file name
+func safeFileName(id string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, id)
+}
+
+// stderrLogName returns the log file name for a delivery ID, which is the
+// safe file name followed by part of a hash of the ID itself, so that IDs
+// differing only in unsafe characters get logs of their own
+func stderrLogName(id string) string {
+	sum := sha1.Sum([]byte(id))
+	return fmt.Sprintf("%s-%x.log", safeFileName(id), sum[:6])
+}
+
+// close finishes the stderr log of the delivery and prunes old logs
+func (sls *stderrLogStore) close(d *Delivery) {
+	d.mu.Lock()
+	log := d.stderrLog
+	d.stderrLog = nil
+	d.mu.Unlock()
+
+	if log == nil {
+		return
+	}
+
+	if err := log.close(); err != nil {
+		logger.Printf("ERROR: failed to close stderr log of delivery %s: %v\n", d.ID, err)
+	}
+
+	if err := sls.prune(); err != nil {
+		logger.Printf("ERROR: failed to prune stderr logs: %v\n", err)
+	}
+}
+
+// prune removes the oldest logs beyond the number to keep
+func (sls *stderrLogStore) prune() error {
+	sls.Lock()
+	defer sls.Unlock()
+
+	infos, err := ioutil.ReadDir(sls.dir)
+	if err != nil {
+		return err
+	}
+
+	var logs []os.FileInfo
+	for _, fi := range infos {
+		if strings.HasSuffix(fi.Name(), ".log") {
+			logs = append(logs, fi)
+		}
+	}
+
+	if len(logs) <= sls.keep {
+		return nil
+	}
+
+	sort.Sort(byModTime(logs))
+	for _, fi := range logs[:len(logs)-sls.keep] {
+		if err := os.Remove(filepath.Join(sls.dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type byModTime []os.FileInfo
+
+func (fis byModTime) Len() int           { return len(fis) }
+func (fis byModTime) Less(i, j int) bool { return fis[i].ModTime().Before(fis[j].ModTime()) }
+func (fis byModTime) Swap(i, j int)      { fis[i], fis[j] = fis[j], fis[i] }
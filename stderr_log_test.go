@@ -0,0 +1,173 @@
+package hookworm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const stderrHandlerBody = `#!/usr/bin/env python
+import sys
+
+if sys.argv[1] == 'configure':
+    sys.exit(0)
+
+sys.stdout.write(sys.stdin.read())
+sys.stderr.write('first line\nsecond line\nno newline')
+`
+
+func TestLineLoggerWritesDeliveryLog(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	sls, err := openStderrLogStore(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Delivery{ID: "abc/../def"}
+	if err := sls.open(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(filepath.Base(d.StderrLog), "abc____def-") {
+		t.Errorf("expected unsafe delivery ID to be replaced in log name: %v", d.StderrLog)
+	}
+
+	other := &Delivery{ID: "abc/.._def"}
+	if err := sls.open(other); err != nil {
+		t.Fatal(err)
+	}
+	sls.close(other)
+
+	if other.StderrLog == d.StderrLog {
+		t.Errorf("expected deliveries whose IDs replace alike to get their own logs: %v", d.StderrLog)
+	}
+
+	ll := newLineLogger("/etc/worm.d/10-a.py", d)
+	ll.Write([]byte("one\ntw"))
+	ll.Write([]byte("o\nthree"))
+	ll.flush()
+	sls.close(d)
+
+	content, err := ioutil.ReadFile(d.StderrLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "10-a.py[abc/../def]: one\n10-a.py[abc/../def]: two\n10-a.py[abc/../def]: three\n"
+	if string(content) != expected {
+		t.Errorf("unexpected log content %q", content)
+	}
+}
+
+func TestLineLoggerTruncatesLongLines(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	sls, err := openStderrLogStore(dir, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Delivery{ID: "long"}
+	if err := sls.open(d); err != nil {
+		t.Fatal(err)
+	}
+
+	ll := newLineLogger("10-a.py", d)
+	for i := 0; i < 3; i++ {
+		ll.Write([]byte(strings.Repeat("x", stderrLineMaxSize/2+1)))
+	}
+
+	if len(ll.buf) >= stderrLineMaxSize {
+		t.Errorf("expected the line buffer to stay under %d bytes, got %d", stderrLineMaxSize, len(ll.buf))
+	}
+
+	ll.flush()
+	sls.close(d)
+
+	content, err := ioutil.ReadFile(d.StderrLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " (truncated)") ||
+		len(lines[0]) != len("10-a.py[long]: ")+stderrLineMaxSize+len(" (truncated)") {
+		t.Errorf("expected the long line to be logged truncated, got %d lines", len(lines))
+	}
+}
+
+func TestStderrLogStorePrunesOldest(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	sls, err := openStderrLogStore(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, id := range []string{"oldest", "older"} {
+		logPath := filepath.Join(sls.dir, id+".log")
+		ioutil.WriteFile(logPath, []byte("x\n"), 0640)
+		then := time.Now().Add(-time.Duration(2-i) * time.Hour)
+		os.Chtimes(logPath, then, then)
+	}
+
+	d := &Delivery{ID: "newest"}
+	if err := sls.open(d); err != nil {
+		t.Fatal(err)
+	}
+	sls.close(d)
+
+	infos, _ := ioutil.ReadDir(sls.dir)
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+
+	if strings.Join(names, ",") != stderrLogName("newest")+",older.log" {
+		t.Errorf("expected oldest log to be pruned, got %v", names)
+	}
+}
+
+func TestDeliveryDispatcherCapturesStderr(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "stderr.py")
+	ioutil.WriteFile(filePath, []byte(stderrHandlerBody), 0755)
+
+	sh, err := newShellHandler(filePath, &HandlerConfig{WormTimeout: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dd := newDeliveryDispatcher(sh, nil, nil, &HandlerConfig{})
+	if dd.stderrLogs, err = openStderrLogStore(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Delivery{ID: "captured", Source: "github"}
+	if err := dd.process(d, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.Results) != 1 || !strings.HasSuffix(d.Results[0].Stderr, "first line\nsecond line\nno newline") {
+		t.Errorf("expected stderr tail in results: %+v", d.Results[0])
+	}
+
+	content, err := ioutil.ReadFile(d.StderrLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(content), "stderr.py[captured]: second line\n") ||
+		!strings.Contains(string(content), "stderr.py[captured]: no newline\n") {
+		t.Errorf("unexpected log content %q", content)
+	}
+}
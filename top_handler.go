@@ -8,18 +8,9 @@ func newTopHandler() *topHandler {
 	return &topHandler{}
 }
 
-func (th *topHandler) HandleGithubPayload(payload string) (string, error) {
+func (th *topHandler) HandlePayload(delivery *Delivery, payload string) (string, error) {
 	if th.next != nil {
-		return th.next.HandleGithubPayload(payload)
-	}
-
-	logger.Println("WARNING: no next handler?")
-	return "", nil
-}
-
-func (th *topHandler) HandleTravisPayload(payload string) (string, error) {
-	if th.next != nil {
-		return th.next.HandleTravisPayload(payload)
+		return th.next.HandlePayload(delivery, payload)
 	}
 
 	logger.Println("WARNING: no next handler?")
@@ -0,0 +1,491 @@
+package hookworm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	workerPingTimeout    = 10 * time.Second
+	workerResponsePrefix = 256
+)
+
+var (
+	errWorkerStopped       = errors.New("persistent handler has been stopped")
+	errWorkerFrameTooLarge = errors.New("response frame too large")
+)
+
+// workerRequest is a frame written to a persistent handler process as a
+// single line of JSON.  The type is either "handle" or "ping".
+type workerRequest struct {
+	ID             uint64 `json:"id"`
+	Type           string `json:"type"`
+	Source         string `json:"source,omitempty"`
+	Event          string `json:"event,omitempty"`
+	Delivery       string `json:"delivery,omitempty"`
+	SourceDelivery string `json:"source_delivery,omitempty"`
+	Payload        string `json:"payload,omitempty"`
+}
+
+// workerResponse is the frame a persistent handler process writes back as a
+// single line of JSON for each request.  The status has the same meaning as
+// the exit status of a handler run once per payload, and the remaining
+// fields as in a result envelope.
+type workerResponse struct {
+	ID          uint64                 `json:"id"`
+	Status      int                    `json:"status"`
+	Payload     string                 `json:"payload"`
+	Error       string                 `json:"error"`
+	Stop        bool                   `json:"stop"`
+	Annotations map[string]interface{} `json:"annotations"`
+	Messages    []string               `json:"messages"`
+}
+
+// workerStatusError is a failure status returned in a worker response
+type workerStatusError struct {
+	status  int
+	message string
+}
+
+func (e *workerStatusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("status %d", e.status)
+	}
+	return fmt.Sprintf("status %d: %s", e.status, e.message)
+}
+
+// workerStderr collects the standard error of a persistent handler
+// process, keeping the tail written since it was last taken and logging
+// each line on behalf of the delivery being handled, if any
+type workerStderr struct {
+	sync.Mutex
+	tailBuffer
+	idle *lineLogger
+	log  *lineLogger
+}
+
+func newWorkerStderr(handler string) *workerStderr {
+	idle := newLineLogger(handler, nil)
+	return &workerStderr{tailBuffer: tailBuffer{max: stderrTailSize}, idle: idle, log: idle}
+}
+
+func (ws *workerStderr) Write(p []byte) (int, error) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	ws.log.Write(p)
+	return ws.tailBuffer.Write(p)
+}
+
+// take returns what has been written since the last call
+func (ws *workerStderr) take() []byte {
+	ws.Lock()
+	defer ws.Unlock()
+
+	buf := ws.buf
+	ws.buf = nil
+	return buf
+}
+
+// logFor logs what is written from now on on behalf of the delivery, or
+// without one if the delivery is nil
+func (ws *workerStderr) logFor(delivery *Delivery) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	ws.log.flush()
+	ws.log = ws.idle
+	if delivery != nil {
+		ws.log = newLineLogger(ws.idle.prefix, delivery)
+	}
+}
+
+// workerProcess is a single run of a persistent handler process
+type workerProcess struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	lines    chan []byte
+	done     chan struct{}
+	frameMax int
+	readErr  error
+	waitErr  error
+}
+
+// read sends each line written to standard output to the lines channel
+// until the process closes it, then waits for the process to exit.  A line
+// longer than the frame max is not buffered any further: the process group
+// is killed and the error is kept in readErr.
+func (wp *workerProcess) read(stdout io.Reader) {
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := readLine(reader, wp.frameMax)
+		if err == errWorkerFrameTooLarge {
+			wp.readErr = fmt.Errorf("%v: exceeds %d bytes", err, wp.frameMax)
+			signalProcessGroup(wp.cmd.Process.Pid, syscall.SIGKILL)
+			break
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			wp.lines <- line
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	close(wp.lines)
+	wp.waitErr = wp.cmd.Wait()
+	close(wp.done)
+}
+
+// readLine reads up to and including the next newline, failing with
+// errWorkerFrameTooLarge once the line is longer than max.  A max of zero
+// is unlimited.
+func readLine(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if max > 0 && len(line) > max {
+			return nil, errWorkerFrameTooLarge
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func (wp *workerProcess) exited() bool {
+	select {
+	case <-wp.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill kills the process along with its process group and waits for it
+func (wp *workerProcess) kill() {
+	wp.terminate(0)
+}
+
+// terminate sends SIGTERM to the process group and then SIGKILL once the
+// process has exited or the grace period has passed, discarding anything
+// written in the meantime.  It returns true if the process itself had to
+// be killed.
+func (wp *workerProcess) terminate(grace time.Duration) bool {
+	pgid := wp.cmd.Process.Pid
+	killed := true
+
+	if grace > 0 {
+		signalProcessGroup(pgid, syscall.SIGTERM)
+
+		expired := time.After(grace)
+	wait:
+		for {
+			select {
+			case <-wp.lines:
+			case <-wp.done:
+				killed = false
+				break wait
+			case <-expired:
+				break wait
+			}
+		}
+	}
+
+	signalProcessGroup(pgid, syscall.SIGKILL)
+	for _ = range wp.lines {
+	}
+	<-wp.done
+
+	return killed
+}
+
+// persistentWorker runs a handler as a long-lived process that is sent
+// each payload as a request frame on standard input and answers with a
+// response frame on standard output, one request at a time.  The process
+// is started again whenever it has exited, and is killed (to be restarted
+// by the next request) when it times out or breaks the protocol.
+type persistentWorker struct {
+	sync.Mutex
+	command *shellCommand
+	proc    *workerProcess
+	stderr  *workerStderr
+	nextID  uint64
+	stopped bool
+	quit    chan struct{}
+}
+
+func newPersistentWorker(command *shellCommand, healthInterval time.Duration) *persistentWorker {
+	pw := &persistentWorker{
+		command: command,
+		stderr:  newWorkerStderr(command.filePath),
+		quit:    make(chan struct{}),
+	}
+
+	if healthInterval > 0 {
+		go pw.checkHealth(healthInterval)
+	}
+
+	return pw
+}
+
+func (pw *persistentWorker) start() error {
+	dir, env, err := pw.command.sandboxDir(nil)
+	if err != nil {
+		return err
+	}
+
+	cmd := pw.command.newCmd(dir, env, "serve")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	cmd.Stderr = pw.stderr
+
+	if err := pw.command.start(cmd); err != nil {
+		return err
+	}
+
+	pw.proc = &workerProcess{
+		cmd:      cmd,
+		stdin:    stdin,
+		lines:    make(chan []byte),
+		done:     make(chan struct{}),
+		frameMax: pw.frameMax(),
+	}
+	go pw.proc.read(stdout)
+
+	logger.Printf("Started persistent handler %v with pid %d\n", pw.command.filePath, cmd.Process.Pid)
+	return nil
+}
+
+// frameMax is the longest response frame read from the process.  The
+// payload is escaped as a JSON string within the frame, which at most
+// trebles its size, and the frame is allowed the same room beyond that as a
+// result envelope.
+func (pw *persistentWorker) frameMax() int {
+	if pw.command.outputMax <= 0 {
+		return 0
+	}
+	return 3*pw.command.outputMax + resultEnvelopeOverhead
+}
+
+// discard kills the current process so that the next request starts a
+// fresh one
+func (pw *persistentWorker) discard() {
+	if pw.proc != nil {
+		pw.proc.kill()
+		pw.proc = nil
+	}
+}
+
+// request sends a frame to the process, starting it if it is not running,
+// and waits up to the timeout for the response.  The caller must hold the
+// lock.
+func (pw *persistentWorker) request(req *workerRequest, timeout time.Duration) (*workerResponse, error) {
+	if pw.stopped {
+		return nil, errWorkerStopped
+	}
+
+	if pw.proc != nil && pw.proc.exited() {
+		logger.Printf("Restarting persistent handler %v, which exited: %v\n", pw.command.filePath, pw.proc.waitErr)
+		pw.proc = nil
+	}
+
+	if pw.proc == nil {
+		if err := pw.start(); err != nil {
+			return nil, err
+		}
+	}
+
+	pw.nextID++
+	req.ID = pw.nextID
+
+	frame, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	proc := pw.proc
+	if _, err := proc.stdin.Write(append(frame, '\n')); err != nil {
+		pw.discard()
+		return nil, fmt.Errorf("failed to write to persistent handler: %v", err)
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case line, ok := <-proc.lines:
+		if !ok {
+			<-proc.done
+			pw.proc = nil
+			if proc.readErr != nil {
+				return nil, fmt.Errorf("invalid response from persistent handler to request %d: %v", req.ID, proc.readErr)
+			}
+			if proc.waitErr != nil {
+				return nil, pw.command.exitError(proc.cmd, proc.waitErr)
+			}
+			return nil, fmt.Errorf("persistent handler exited unexpectedly")
+		}
+
+		resp := &workerResponse{}
+		if err := json.Unmarshal(line, resp); err != nil || resp.ID != req.ID {
+			pw.discard()
+			if len(line) > workerResponsePrefix {
+				line = line[:workerResponsePrefix]
+			}
+			return nil, fmt.Errorf("invalid response from persistent handler to request %d: %q", req.ID, line)
+		}
+
+		return resp, nil
+	case <-expired:
+		logger.Printf("Timed out persistent handler %v after %v, terminating process group %d\n",
+			pw.command.filePath, timeout, proc.cmd.Process.Pid)
+		pw.proc = nil
+		killed := proc.terminate(time.Duration(pw.command.grace) * time.Second)
+		return nil, &exitTimeout{timeout: int(timeout / time.Second), killed: killed}
+	}
+}
+
+// handle sends the payload to the process, returning the handled payload
+// along with the tail of standard error written while handling it
+func (pw *persistentWorker) handle(delivery *Delivery, payload string) (*handlerOutput, error) {
+	pw.Lock()
+	defer pw.Unlock()
+
+	pw.stderr.take()
+	pw.stderr.logFor(delivery)
+	defer pw.stderr.logFor(nil)
+
+	resp, err := pw.request(&workerRequest{
+		Type:           "handle",
+		Source:         delivery.Source,
+		Event:          delivery.Event,
+		Delivery:       delivery.ID,
+		SourceDelivery: delivery.SourceID,
+		Payload:        payload,
+	}, time.Duration(pw.command.timeout)*time.Second)
+	if err != nil {
+		return &handlerOutput{stderr: pw.stderr.take()}, err
+	}
+
+	output := &handlerOutput{stderr: pw.stderr.take()}
+	if resp.Stop || resp.Annotations != nil || resp.Messages != nil {
+		output.envelope = &resultEnvelope{
+			Stop:        resp.Stop,
+			Annotations: resp.Annotations,
+			Messages:    resp.Messages,
+		}
+	}
+
+	switch resp.Status {
+	case 0:
+		output.out = []byte(resp.Payload)
+		return output, nil
+	case 75:
+		return output, &exitTempfail{}
+	case 78:
+		return output, &exitNoop{}
+	default:
+		return output, &workerStatusError{status: resp.Status, message: resp.Error}
+	}
+}
+
+// ping checks that the process responds, starting it if it is not running
+// and killing it so that it is restarted if it does not respond properly
+func (pw *persistentWorker) ping() error {
+	pw.Lock()
+	defer pw.Unlock()
+
+	if pw.stopped {
+		return nil
+	}
+
+	timeout := time.Duration(pw.command.timeout) * time.Second
+	if timeout <= 0 {
+		timeout = workerPingTimeout
+	}
+
+	resp, err := pw.request(&workerRequest{Type: "ping"}, timeout)
+	if err == nil && resp.Status != 0 {
+		pw.discard()
+		err = &workerStatusError{status: resp.Status, message: resp.Error}
+	}
+
+	if err != nil {
+		logger.Printf("Persistent handler %v failed health check: %v\n", pw.command.filePath, err)
+	}
+
+	return err
+}
+
+func (pw *persistentWorker) checkHealth(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pw.quit:
+			return
+		case <-ticker.C:
+			pw.ping()
+		}
+	}
+}
+
+// stop shuts the process down by closing its standard input, killing it if
+// it has not exited within the handler timeout.  Requests made after stop
+// fail with errWorkerStopped.
+func (pw *persistentWorker) stop() {
+	pw.Lock()
+	defer pw.Unlock()
+
+	if pw.stopped {
+		return
+	}
+
+	pw.stopped = true
+	close(pw.quit)
+
+	if pw.proc == nil {
+		return
+	}
+
+	proc := pw.proc
+	pw.proc = nil
+	proc.stdin.Close()
+
+	timeout := time.Duration(pw.command.timeout) * time.Second
+	if timeout <= 0 {
+		timeout = workerPingTimeout
+	}
+
+	select {
+	case <-proc.done:
+	case <-time.After(timeout):
+		proc.kill()
+	}
+
+	logger.Printf("Stopped persistent handler %v\n", pw.command.filePath)
+}
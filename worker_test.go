@@ -0,0 +1,355 @@
+package hookworm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const persistentHandlerBody = `#!/usr/bin/env python
+import json
+import os
+import sys
+import time
+
+if sys.argv[1] == 'configure':
+    json.dump({'persistent': True}, sys.stdout)
+    sys.exit(0)
+
+if sys.argv[1] == 'handle':
+    payload = json.load(sys.stdin)
+    payload['mode'] = 'fork'
+    json.dump(payload, sys.stdout)
+    sys.exit(0)
+
+count = 0
+for line in sys.stdin:
+    req = json.loads(line)
+    resp = {'id': req['id'], 'status': 0}
+
+    if req['type'] == 'handle':
+        count += 1
+        payload = json.loads(req['payload'])
+        if payload.get('crash'):
+            os._exit(3)
+        if payload.get('hang'):
+            time.sleep(5)
+        if payload.get('flood'):
+            sys.stdout.write('x' * payload['flood'])
+            sys.stdout.flush()
+            time.sleep(5)
+        if payload.get('garbage'):
+            sys.stdout.write('not json\n')
+            sys.stdout.flush()
+            continue
+        if payload.get('status'):
+            resp.update({'status': payload['status'], 'error': 'nope'})
+        if payload.get('stop'):
+            resp.update({'stop': True, 'annotations': {'pid': os.getpid()}, 'messages': ['stopping']})
+        payload.update({'mode': 'serve', 'pid': os.getpid(), 'count': count, 'event': req.get('event')})
+        resp['payload'] = json.dumps(payload)
+
+    sys.stdout.write(json.dumps(resp) + '\n')
+    sys.stdout.flush()
+`
+
+type persistentTestResult struct {
+	Mode  string `json:"mode"`
+	Pid   int    `json:"pid"`
+	Count int    `json:"count"`
+	Event string `json:"event"`
+}
+
+func setupPersistentHandler(t *testing.T) (string, *shellHandler) {
+	dir := newJournalTestDir(t)
+	filePath := filepath.Join(dir, "persistent.py")
+	ioutil.WriteFile(filePath, []byte(persistentHandlerBody), 0755)
+
+	sh, err := newShellHandler(filePath, &HandlerConfig{WormTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sh.configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sh.worker == nil {
+		t.Fatalf("expected handler declaring persistent to get a worker")
+	}
+
+	return dir, sh
+}
+
+func handlePersistent(sh *shellHandler, payload string, t *testing.T) (*persistentTestResult, error) {
+	out, err := sh.HandlePayload(&Delivery{Source: "github", Event: "push"}, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &persistentTestResult{}
+	if err := json.Unmarshal([]byte(out), result); err != nil {
+		t.Fatalf("unexpected output %q: %v", out, err)
+	}
+	return result, nil
+}
+
+func TestPersistentHandlerReusesProcess(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+	defer sh.stopWorker()
+
+	first, err := handlePersistent(sh, `{}`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := handlePersistent(sh, `{}`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Mode != "serve" || first.Event != "push" || first.Pid != second.Pid || second.Count != first.Count+1 {
+		t.Errorf("expected both payloads to be handled by one process, got %+v %+v", first, second)
+	}
+
+	out, err := sh.HandlePayload(&Delivery{Source: "github"}, `{"status":78}`)
+	if err != nil || out != `{"status":78}` {
+		t.Errorf("expected no-op status to pass payload through, got %q %v", out, err)
+	}
+
+	_, err = sh.HandlePayload(&Delivery{Source: "github"}, `{"status":2}`)
+	if he, ok := err.(*handlerError); !ok || he.ExitStatus != 2 {
+		t.Errorf("expected failure status to be reported, got %v", err)
+	}
+}
+
+func TestPersistentHandlerRestartsAfterFailures(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+	defer sh.stopWorker()
+
+	first, _ := handlePersistent(sh, `{}`, t)
+
+	for _, payload := range []string{`{"crash":true}`, `{"hang":true}`, `{"garbage":true}`} {
+		if _, err := handlePersistent(sh, payload, t); err == nil {
+			t.Errorf("expected %s to fail", payload)
+		}
+
+		next, err := handlePersistent(sh, `{}`, t)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Pid == first.Pid || next.Count != 1 {
+			t.Errorf("expected a new process after %s, got %+v", payload, next)
+		}
+		first = next
+	}
+
+	_, err := handlePersistent(sh, `{"hang":true}`, t)
+	if he, ok := err.(*handlerError); !ok || !isTransient(he.Err) {
+		t.Errorf("expected timeout, got %v", err)
+	}
+}
+
+func TestPersistentHandlerBoundsResponseFrames(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+	defer sh.stopWorker()
+
+	sh.command.outputMax = 1024
+	sh.command.timeout = 10
+
+	sh.worker.Lock()
+	sh.worker.discard()
+	sh.worker.Unlock()
+
+	first, _ := handlePersistent(sh, `{}`, t)
+
+	start := time.Now()
+	_, err := handlePersistent(sh, `{"flood":1048576}`, t)
+	if err == nil || !strings.Contains(err.Error(), "response frame too large") {
+		t.Errorf("expected an oversized response frame to fail the delivery, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the oversized frame to be rejected without waiting for the process, took %v", elapsed)
+	}
+
+	next, err := handlePersistent(sh, `{}`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Pid == first.Pid || next.Count != 1 {
+		t.Errorf("expected a new process after an oversized frame, got %+v", next)
+	}
+}
+
+func TestPersistentHandlerHealthCheck(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+	defer sh.stopWorker()
+
+	first, _ := handlePersistent(sh, `{}`, t)
+
+	sh.worker.Lock()
+	sh.worker.proc.cmd.Process.Kill()
+	<-sh.worker.proc.done
+	sh.worker.Unlock()
+
+	if err := sh.worker.ping(); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := handlePersistent(sh, `{}`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Pid == first.Pid {
+		t.Errorf("expected health check to restart the process")
+	}
+}
+
+func TestStoppedPersistentHandlerForksPerPayload(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+
+	sh.stopWorker()
+
+	result, err := handlePersistent(sh, `{}`, t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Mode != "fork" {
+		t.Errorf("expected stopped worker to fall back to forking, got %+v", result)
+	}
+}
+
+func TestManifestPersistentOverride(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "persistent.py"), []byte(persistentHandlerBody), 0755)
+
+	disabled := false
+	sh, err := newManifestShellHandler(&manifestHandler{Command: "persistent.py", Persistent: &disabled},
+		&HandlerConfig{WormDir: dir, WormTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sh.configure()
+	if sh.worker != nil {
+		t.Errorf("expected manifest to override persistent declaration")
+	}
+}
+
+func TestFailedConfigureStartsNoPersistentProcess(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.sh"), []byte("#!/bin/sh\nexit 1\n"), 0755)
+
+	enabled := true
+	sh, err := newManifestShellHandler(&manifestHandler{Command: "broken.sh", Persistent: &enabled},
+		&HandlerConfig{WormDir: dir, WormTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sh.configure(); err == nil {
+		t.Fatal("expected configure to fail")
+	}
+
+	if sh.worker != nil {
+		sh.stopWorker()
+		t.Errorf("expected no persistent process for a handler that failed to configure")
+	}
+}
+
+func TestReloadKeepsUnchangedPersistentHandlers(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "10-persistent.py"), []byte(persistentHandlerBody), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "20-persistent.py"), []byte(persistentHandlerBody), 0755)
+
+	rp, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.HandlePayload(&Delivery{Source: "github"}, `{}`); err != nil {
+		t.Fatal(err)
+	}
+
+	old := shellHandlersByKey(rp.pipeline())
+
+	os.Remove(filepath.Join(dir, "20-persistent.py"))
+	if err := rp.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	unchanged := shellHandlersByKey(rp.pipeline())[filepath.Join(dir, "10-persistent.py")]
+	if unchanged.worker == nil || unchanged.worker != old[unchanged.command.filePath].worker || unchanged.worker.stopped {
+		t.Errorf("expected unchanged handler to keep its persistent process")
+	}
+
+	if removed := old[filepath.Join(dir, "20-persistent.py")]; !removed.worker.stopped {
+		t.Errorf("expected removed handler's persistent process to be stopped")
+	}
+
+	unchanged.stopWorker()
+}
+
+func TestReloadKeepsRepeatedPersistentHandlers(t *testing.T) {
+	dir := newJournalTestDir(t)
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "persistent.py"), []byte(persistentHandlerBody), 0755)
+	ioutil.WriteFile(filepath.Join(dir, wormManifestName),
+		[]byte(`{"handlers": [{"command": "persistent.py"}, {"command": "persistent.py"}]}`), 0644)
+
+	rp, err := newReloadablePipeline(&HandlerConfig{WormDir: dir, WormTimeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := shellHandlers(rp.pipeline())
+	if len(old) != 2 || old[0].worker == nil || old[1].worker == nil || old[0].worker == old[1].worker {
+		t.Fatalf("expected each listing to get its own persistent process")
+	}
+
+	if err := rp.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := shellHandlers(rp.pipeline())
+	for i, sh := range reloaded {
+		if sh.worker != old[i].worker || sh.worker.stopped {
+			t.Errorf("expected listing %d to keep its own persistent process", i)
+		}
+		sh.stopWorker()
+	}
+}
+
+func TestPersistentHandlerResultFields(t *testing.T) {
+	dir, sh := setupPersistentHandler(t)
+	defer os.RemoveAll(dir)
+	defer sh.stopWorker()
+
+	delivery := &Delivery{Source: "github", Event: "push"}
+	if _, err := sh.HandlePayload(delivery, `{"stop":true}`); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(delivery.Results) != 1 {
+		t.Fatalf("expected 1 result: %+v", delivery.Results)
+	}
+
+	result := delivery.Results[0]
+	if !result.Stop || result.Annotations["pid"] == nil || len(result.Messages) != 1 {
+		t.Errorf("expected response fields to be recorded: %+v", result)
+	}
+}